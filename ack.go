@@ -0,0 +1,105 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"time"
+)
+
+// AckTimeoutHandler is invoked when a message is not acknowledged within the period set with SetAckTimeout
+type AckTimeoutHandler func(client Client, msg Message)
+
+// Nack indicates that the message will not be acknowledged; as MQTT v3.1.1 has no negative acknowledgement nothing
+// is sent to the broker, but later acknowledgements are no longer held up waiting for this message (see
+// SetOrderedAcks) and the broker should redeliver it when the session is resumed (after reconnecting with
+// CleanSession false). Calling Ack after Nack (or Nack after Ack) has no effect; when auto-ack is enabled, calling
+// Nack within the handler prevents the message being acknowledged when the handler returns.
+//
+// Returns false if m does not support Nack (i.e. it was not received by this package).
+func Nack(m Message) bool {
+	if n, ok := m.(interface{ Nack() }); ok {
+		n.Nack()
+		return true
+	}
+	return false
+}
+
+// Nack indicates that the message will not be acknowledged (see the Nack function)
+func (m *message) Nack() {
+	m.abandon()
+}
+
+// Nack passes the Nack to the wrapped message
+func (m *paramMessage) Nack() {
+	Nack(m.Message)
+}
+
+// Nack passes the Nack to the wrapped message
+func (m *namespacedMessage) Nack() {
+	Nack(m.Message)
+}
+
+// nacked returns true if m will not be acknowledged (i.e. it was passed to Nack, the handler panicked etc.)
+func nacked(m Message) bool {
+	n, ok := m.(interface{ isNacked() bool })
+	return ok && n.isNacked()
+}
+
+func (m *message) isNacked() bool {
+	return m.nacked.Load()
+}
+
+func (m *paramMessage) isNacked() bool {
+	return nacked(m.Message)
+}
+
+func (m *namespacedMessage) isNacked() bool {
+	return nacked(m.Message)
+}
+
+// sequenceAck ensures that the acknowledgement for m is released in the order the message was received if the
+// sequencer is ordered (and, if the client has an AckTimeout, abandons the message if it is not acknowledged in time)
+func (c *client) sequenceAck(s *ackSequencer, m *message) {
+	seq := s.allocate()
+	ack := m.ack
+	release := func() { s.complete(seq, nil) } // also stops the timer
+	m.ack = func() { s.complete(seq, ack) }
+	m.noAck = release
+	if timeout := c.options.AckTimeout; timeout > 0 && c.options.AutoAckDisabled {
+		s.setTimer(seq, time.AfterFunc(timeout, func() {
+			if !s.isStopped() { // the connection (and the ACK that would be released) is gone
+				c.ackTimedOut(m, release)
+			}
+		}))
+	}
+}
+
+// ackTimedOut is called when m has not been acknowledged within the AckTimeout; release is called to abandon
+// the message
+func (c *client) ackTimedOut(m *message, release func()) {
+	expired := false
+	m.once.Do(func() {
+		expired = true
+		m.nacked.Store(true)
+		release()
+	})
+	if !expired { // acknowledged (or abandoned) just as the timer fired
+		return
+	}
+	c.ackTimeouts.Add(1)
+	WARN.Println(ROU, "message not acknowledged within timeout (it will not be acknowledged), topic:", m.Topic(), "id:", m.MessageID())
+	if c.options.OnAckTimeout != nil {
+		c.options.OnAckTimeout(c, m)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// PublishResult is passed to the PublishCallback when a publish made with PublishAsync completes
+type PublishResult struct {
+	Topic     string        // The topic passed to PublishAsync
+	MessageID uint16        // The packet ID used (0 for QoS 0 messages or if the publish failed before one was allocated)
+	Latency   time.Duration // Time from the call to PublishAsync until the publish completed
+	Err       error         // nil if the publish succeeded (QoS 1/2: acknowledged by the broker, QoS 0: sent)
+}
+
+// PublishCallback is called with the result of a PublishAsync
+type PublishCallback func(PublishResult)
+
+// callbackQueue holds callbacks awaiting execution; they are run, in order, on a goroutine that is started when
+// the queue becomes non-empty and exits once it is drained. Adding to the queue never blocks.
+type callbackQueue struct {
+	mu      sync.Mutex
+	queue   []func()
+	running bool // true if a goroutine is running the callbacks
+}
+
+// len returns the number of callbacks waiting to be run
+func (q *callbackQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queue)
+}
+
+// PublishAsync publishes a message (as per Publish) calling callback with the result when the publish completes
+// (for QoS 1 and 2 when the broker acknowledges it) or fails. The callback is run on a goroutine managed by the
+// client (never the goroutines handling network traffic); callbacks are run one at a time in the order the
+// publishes completed, so a callback that blocks will delay those that follow (and Close). callback may be nil.
+func (c *client) PublishAsync(topic string, qos byte, retained bool, payload interface{}, callback PublishCallback) {
+	c.publish(topic, qos, retained, payload, c.asyncToken(topic, callback))
+}
+
+// asyncToken returns a PublishToken that will queue a call to callback when it completes; topic is the topic
+// reported in the PublishResult
+func (c *client) asyncToken(topic string, callback PublishCallback) *PublishToken {
+	token := newToken(packets.Publish).(*PublishToken)
+	if callback == nil {
+		return token
+	}
+	start := time.Now()
+	token.onComplete = func() { // Called from the goroutine completing the token (which may be a comms goroutine)
+		r := PublishResult{Topic: topic, MessageID: token.messageID, Latency: time.Since(start), Err: token.Error()}
+		c.queueCallback(func() { callback(r) })
+	}
+	return token
+}
+
+// queueCallback adds f to the callback queue (starting a goroutine to run it if one is not already running)
+func (c *client) queueCallback(f func()) {
+	c.callbacks.add(f, c.goTracked)
+}
+
+// add appends f to the queue; if a goroutine is not already running the queue then one is started with start
+func (q *callbackQueue) add(f func(), start func(func())) {
+	q.mu.Lock()
+	q.queue = append(q.queue, f)
+	idle := !q.running
+	q.running = true
+	q.mu.Unlock()
+	if idle {
+		start(q.run)
+	}
+}
+
+// run runs queued callbacks until the queue is empty
+func (q *callbackQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.queue) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		f := q.queue[0]
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+		runCallback(f)
+	}
+}
+
+// runCallback calls f, recovering from (and logging) any panic so that later callbacks are still run
+func runCallback(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			ERROR.Println(CLI, fmt.Sprintf("queued callback panicked: %v", r))
+		}
+	}()
+	f()
+}
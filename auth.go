@@ -0,0 +1,108 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ErrAuthCredentialsExpiring is passed to the ConnectionLostHandler when the connection is dropped because the
+// credentials used to establish it are about to expire (see ClientOptions.SetAuthProvider)
+var ErrAuthCredentialsExpiring = errors.New("credentials nearing expiry; reconnecting")
+
+// authRefreshMinWait is the minimum time a connection is used before reconnecting to refresh credentials (so that
+// credentials which have expired, or will expire within AuthRefreshBefore, do not result in a reconnection loop)
+const authRefreshMinWait = 5 * time.Second
+
+// Credentials are returned by an AuthProvider and will be used in the CONNECT packet. Expiry should be set if the
+// credentials (e.g. a token) are only valid for a limited time; the zero value means they do not expire.
+type Credentials struct {
+	Username string
+	Password string
+	Expiry   time.Time
+}
+
+// AuthProvider supplies the credentials used each time a connection is established. refresh will be true if
+// the broker rejected the previous credentials (bad username/password or not authorised) so any cached
+// credentials should be discarded. If an error is returned the connection attempt to the current broker fails.
+type AuthProvider interface {
+	Credentials(refresh bool) (Credentials, error)
+}
+
+// AuthProviderFunc allows a function to be used as an AuthProvider
+type AuthProviderFunc func(refresh bool) (Credentials, error)
+
+// Credentials calls f(refresh)
+func (f AuthProviderFunc) Credentials(refresh bool) (Credentials, error) {
+	return f(refresh)
+}
+
+// applyAuthProvider requests credentials from the provider and sets them in the connect packet
+func applyAuthProvider(cm *packets.ConnectPacket, p AuthProvider, refresh bool) (time.Time, error) {
+	creds, err := p.Credentials(refresh)
+	if err != nil {
+		return time.Time{}, err
+	}
+	cm.UsernameFlag, cm.Username = false, ""
+	cm.PasswordFlag, cm.Password = false, nil
+	if creds.Username != "" {
+		cm.UsernameFlag = true
+		cm.Username = creds.Username
+		// mustn't have password without user as well
+		if creds.Password != "" {
+			cm.PasswordFlag = true
+			cm.Password = []byte(creds.Password)
+		}
+	}
+	return creds.Expiry, nil
+}
+
+// isAuthRejection returns true if the CONNACK return code indicates that the credentials were not accepted
+func isAuthRejection(rc byte) bool {
+	return rc == packets.ErrRefusedBadUsernameOrPassword || rc == packets.ErrRefusedNotAuthorised
+}
+
+// watchAuthExpiry waits until the credentials used to establish the connection are about to expire and then
+// reconnects (so that fresh credentials are requested from the AuthProvider)
+func watchAuthExpiry(c *client, expiry time.Time) {
+	defer c.workers.Done()
+	wait := authRefreshWait(time.Until(expiry), c.options.AuthRefreshBefore, c.authMinWait)
+	DEBUG.Println(CLI, "credentials expire at", expiry, "reconnect scheduled in", wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-c.stop:
+		DEBUG.Println(CLI, "credential expiry watch stopped")
+	case <-timer.C:
+		WARN.Println(CLI, ErrAuthCredentialsExpiring.Error())
+		c.reconnectGracefully(ErrAuthCredentialsExpiring)
+	}
+}
+
+// authRefreshWait returns how long to wait before reconnecting given the remaining lifetime of the credentials.
+// This is normally remaining-before but is at least half of the remaining lifetime (an AuthProvider may reuse
+// credentials for some of their lifetime, e.g. JWTAuthProvider) and never less than min.
+func authRefreshWait(remaining, before, min time.Duration) time.Duration {
+	wait := remaining - before
+	if wait < remaining/2 {
+		wait = remaining / 2
+	}
+	if wait < min {
+		wait = min
+	}
+	return wait
+}
@@ -0,0 +1,184 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"sync"
+)
+
+// OverflowPolicy determines what happens when a message arrives for a ChanSubscription whose channel is full
+type OverflowPolicy byte
+
+const (
+	// OverflowBlock waits until there is space in the channel. Note that this blocks the router (so, depending upon
+	// the dispatch options, may delay the delivery of other messages and reading from the network).
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards (and acknowledges) the oldest message in the channel to make room for the new one
+	OverflowDropOldest
+	// OverflowDropNewest discards (and acknowledges) the new message
+	OverflowDropNewest
+)
+
+// ChanSubscription delivers the messages received on a subscription to a channel (see Client.SubscribeChan).
+// Messages are acknowledged once they have been delivered to the channel, unless SetAutoAckDisabled is in use in
+// which case the receiver must call Message.Ack. Messages that are dropped (due to the OverflowPolicy or because
+// the subscription has been cancelled) are acknowledged when they are dropped (regardless of SetAutoAckDisabled)
+// so that they do not delay the acknowledgement of other messages; they will not be redelivered.
+type ChanSubscription struct {
+	client *client
+	sub    *Subscription
+	policy OverflowPolicy
+
+	ch        chan Message
+	done      chan struct{} // closed when the subscription is cancelled (prior to ch being closed)
+	mu        sync.RWMutex  // held (read) whilst sending to ch so that it is not closed during a send
+	closed    bool
+	closeOnce sync.Once
+}
+
+// C returns the channel on which messages will be delivered; it will be closed when the subscription is cancelled
+// or the client is disconnected permanently (Disconnect called or connection lost with AutoReconnect disabled).
+func (s *ChanSubscription) C() <-chan Message {
+	return s.ch
+}
+
+// Topic returns the topic filter subscribed to
+func (s *ChanSubscription) Topic() string {
+	return s.sub.Topic()
+}
+
+// Subscription returns the underlying Subscription handle (which may be used to pause delivery or
+// retrieve statistics)
+func (s *ChanSubscription) Subscription() *Subscription {
+	return s.sub
+}
+
+// Done returns a channel that is closed when the subscription is cancelled
+func (s *ChanSubscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Dropped returns the number of messages discarded due to the OverflowPolicy (or because the subscription
+// was paused)
+func (s *ChanSubscription) Dropped() uint64 {
+	return s.sub.Dropped()
+}
+
+// Cancel releases the subscription and closes the channel (any messages in the channel may still be read).
+// The returned token is as per Subscription.Unsubscribe.
+func (s *ChanSubscription) Cancel() Token {
+	s.close()
+	return s.sub.Unsubscribe()
+}
+
+// deliver is the MessageHandler for the subscription
+func (s *ChanSubscription) deliver(_ Client, m Message) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		m.Ack()
+		return
+	}
+	switch s.policy {
+	case OverflowDropNewest:
+		select {
+		case s.ch <- m:
+		default:
+			s.sub.dropped.Add(1)
+			DEBUG.Println(CLI, "ChanSubscription full, message dropped, topic:", m.Topic())
+			m.Ack()
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.ch <- m:
+				return
+			default:
+			}
+			select { // channel is full so remove the oldest message (unless a reader has already done so)
+			case old := <-s.ch:
+				s.sub.dropped.Add(1)
+				DEBUG.Println(CLI, "ChanSubscription full, oldest message dropped, topic:", old.Topic())
+				old.Ack()
+			default:
+			}
+		}
+	default:
+		select {
+		case s.ch <- m:
+		case <-s.done:
+			m.Ack()
+		}
+	}
+}
+
+// close closes the channel (if not already closed) and removes the subscription from the client
+func (s *ChanSubscription) close() {
+	s.closeOnce.Do(func() {
+		close(s.done) // unblocks deliver if it is waiting
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+		s.client.chanSubsMu.Lock()
+		delete(s.client.chanSubs, s)
+		s.client.chanSubsMu.Unlock()
+	})
+}
+
+// SubscribeChan subscribes to topic with messages being delivered to the channel returned by
+// ChanSubscription.C (which has a buffer of bufferSize messages). overflow determines what happens when a message
+// arrives and the channel is full. The returned token tracks the SUBSCRIBE; if this fails the subscription should
+// be cancelled.
+func (c *client) SubscribeChan(topic string, qos byte, bufferSize int, overflow OverflowPolicy) (*ChanSubscription, Token) {
+	return c.subscribeChan(topic, qos, bufferSize, overflow, nil)
+}
+
+// subscribeChan implements SubscribeChan; if wrap is not nil it is applied to the handler that delivers messages
+// to the channel
+func (c *client) subscribeChan(topic string, qos byte, bufferSize int, overflow OverflowPolicy, wrap MessageMiddleware) (*ChanSubscription, Token) {
+	s := &ChanSubscription{
+		client: c,
+		policy: overflow,
+		ch:     make(chan Message, bufferSize),
+		done:   make(chan struct{}),
+	}
+	c.chanSubsMu.Lock()
+	if c.chanSubs == nil {
+		c.chanSubs = make(map[*ChanSubscription]struct{})
+	}
+	c.chanSubs[s] = struct{}{}
+	c.chanSubsMu.Unlock()
+	handler := MessageHandler(s.deliver)
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	var token Token
+	s.sub, token = c.SubscribeWithHandle(topic, qos, handler)
+	return s, token
+}
+
+// closeChanSubscriptions closes all ChanSubscriptions (called when the client is disconnected permanently)
+func (c *client) closeChanSubscriptions() {
+	c.chanSubsMu.Lock()
+	subs := make([]*ChanSubscription, 0, len(c.chanSubs))
+	for s := range c.chanSubs {
+		subs = append(subs, s)
+	}
+	c.chanSubsMu.Unlock()
+	for _, s := range subs {
+		s.close()
+		s.sub.detach() // the connection is gone so there is no need to UNSUBSCRIBE
+	}
+}
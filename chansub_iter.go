@@ -0,0 +1,34 @@
+//go:build go1.23
+
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import "iter"
+
+// Messages returns an iterator over the messages received on the subscription; iteration ends when the
+// subscription is closed. Breaking out of the loop does not cancel the subscription.
+//
+//	for m := range sub.Messages() {
+//		...
+//	}
+func (s *ChanSubscription) Messages() iter.Seq[Message] {
+	return func(yield func(Message) bool) {
+		for m := range s.ch {
+			if !yield(m) {
+				return
+			}
+		}
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
@@ -60,7 +61,9 @@ import (
 // Numerous connection options may be specified by configuring a
 // and then supplying a ClientOptions type.
 // Implementations of Client must be safe for concurrent use by multiple
-// goroutines
+// goroutines.
+//
+// Further functionality is available through the optional interfaces below (e.g. Shutdowner).
 type Client interface {
 	// IsConnected returns a bool signifying whether
 	// the client is connected or not.
@@ -78,7 +81,9 @@ type Client interface {
 	Disconnect(quiesce uint)
 	// Publish will publish a message with the specified QoS and content
 	// to the specified topic.
-	// Returns a token to track delivery of the message to the broker
+	// Returns a token to track delivery of the message to the broker; if the topic is not a
+	// valid topic name the token will fail with a *TopicError. If local delivery is enabled
+	// (see SetLocalDelivery) the message is also queued for delivery to matching routes.
 	Publish(topic string, qos byte, retained bool, payload interface{}) Token
 	// Subscribe starts a new subscription. Provide a MessageHandler to be executed when
 	// a message is published on the topic provided, or nil for the default handler.
@@ -87,6 +92,9 @@ type Client interface {
 	// call functions within this package that may block (e.g. Publish) other than in
 	// a new go routine.
 	// callback must be safe for concurrent use by multiple goroutines.
+	//
+	// If enabled with SetRouteParams, topic may be a route pattern containing named parameters, e.g.
+	// site/{site}/#rest (see ParamMessage).
 	Subscribe(topic string, qos byte, callback MessageHandler) Token
 	// SubscribeMultiple starts a new subscription for multiple topics. Provide a MessageHandler to
 	// be executed when a message is published on one of the topics provided, or nil for the
@@ -110,12 +118,87 @@ type Client interface {
 	// call functions within this package that may block (e.g. Publish) other than in
 	// a new go routine.
 	// callback must be safe for concurrent use by multiple goroutines.
+	//
+	// topic may be a route pattern containing named parameters if enabled with SetRouteParams (see ParamMessage).
 	AddRoute(topic string, callback MessageHandler)
 	// OptionsReader returns a ClientOptionsReader which is a copy of the clientoptions
 	// in use by the client.
 	OptionsReader() ClientOptionsReader
 }
 
+// The Client returned by NewClient (or NewNamespacedClient) also implements the interfaces below (and io.Closer,
+// see Close). These are not part of Client so that existing implementations of it (e.g. mocks) continue to compile;
+// use a type assertion to access them, e.g.
+//
+//	if s, ok := c.(mqtt.Shutdowner); ok {
+//		err = s.Shutdown(ctx)
+//	}
+
+// MiddlewareRouter is implemented by clients supporting message handler middleware
+type MiddlewareRouter interface {
+	// AddRouteWithMiddleware is equivalent to AddRoute but the callback will be wrapped with the
+	// middleware provided (in addition to any added with Use).
+	AddRouteWithMiddleware(topic string, callback MessageHandler, middleware ...MessageMiddleware)
+	// Use adds middleware that will be applied to every message handler (including the default
+	// handler). Middleware is applied in the order provided (the first will be called first) and
+	// wraps any route specific middleware.
+	Use(middleware ...MessageMiddleware)
+}
+
+// ChanSubscriber is implemented by clients supporting channel based subscriptions
+type ChanSubscriber interface {
+	// SubscribeChan starts a new subscription with messages being delivered to a channel (see
+	// ChanSubscription). bufferSize is the capacity of the channel and overflow determines what
+	// happens when a message arrives and the channel is full.
+	SubscribeChan(topic string, qos byte, bufferSize int, overflow OverflowPolicy) (*ChanSubscription, Token)
+}
+
+// HandleSubscriber is implemented by clients supporting Subscription handles
+type HandleSubscriber interface {
+	// SubscribeWithHandle starts a new subscription returning a Subscription that owns callback.
+	// Unlike Subscribe, any number of handles may exist for the same topic (each handler will be
+	// called); the UNSUBSCRIBE is sent when the last handle is released (see Subscription). A filter
+	// subscribed to with Subscribe is counted as one further holder; it is released by Unsubscribe.
+	SubscribeWithHandle(topic string, qos byte, callback MessageHandler) (*Subscription, Token)
+}
+
+// StatsReporter is implemented by clients that maintain ClientStats
+type StatsReporter interface {
+	// Stats returns a snapshot of the clients internal counters (e.g. the length of the dispatch queue)
+	Stats() ClientStats
+}
+
+// Shutdowner is implemented by clients supporting a graceful shutdown
+type Shutdowner interface {
+	// Shutdown stops accepting new publishes, waits for outstanding publishes and message handlers to
+	// complete (or ctx to expire) and then disconnects; a *ShutdownError is returned if anything was left
+	// outstanding.
+	Shutdown(ctx context.Context) error
+}
+
+// AsyncPublisher is implemented by clients supporting publishing with a completion callback
+type AsyncPublisher interface {
+	// PublishAsync publishes a message (as per Publish) and, rather than returning a token, calls
+	// callback with the result when the publish completes (or fails). Callbacks are run, in the order
+	// the publishes complete, on a goroutine managed by the client, so they never block the network
+	// goroutines (but a slow callback will delay those that follow).
+	PublishAsync(topic string, qos byte, retained bool, payload interface{}, callback PublishCallback)
+}
+
+// extendedClient is the set of interfaces implemented by the clients in this package
+type extendedClient interface {
+	Client
+	io.Closer
+	MiddlewareRouter
+	ChanSubscriber
+	HandleSubscriber
+	StatsReporter
+	Shutdowner
+	AsyncPublisher
+}
+
+var _ extendedClient = (*client)(nil)
+
 // client implements the Client interface
 // clients are safe for concurrent use by multiple
 // goroutines
@@ -123,6 +206,9 @@ type client struct {
 	lastSent        atomic.Value // time.Time - the last time a packet was successfully sent to network
 	lastReceived    atomic.Value // time.Time - the last time a packet was successfully received from network
 	pingOutstanding int32        // set to 1 if a ping has been sent but response not ret received
+	authExpiry      atomic.Value // time.Time - expiry of the credentials (from AuthProvider) used for the current connection
+
+	reconnectReason atomic.Pointer[error] // set by reconnectGracefully; reported in place of the error that caused the connection to drop
 
 	status connectionStatus // see constants in status.go for values
 
@@ -143,6 +229,40 @@ type client struct {
 	commsStopped chan struct{}  // closed when the comms routines have stopped (kept running until after workers have closed to avoid deadlocks)
 
 	backoff *backoffController
+
+	chanSubs   map[*ChanSubscription]struct{} // subscriptions to close if the client is disconnected permanently
+	chanSubsMu sync.Mutex
+
+	subHandles   map[string][]*Subscription // Subscription handles by topic filter (UNSUBSCRIBE sent when the last is released)
+	subPlain     map[string]byte            // QoS of filters subscribed to with Subscribe (counted as a holder, see subHandles)
+	subHandlesMu sync.Mutex
+
+	policyDenials atomic.Uint64 // operations denied by the TopicPolicy
+
+	echoes *echoTracker // nil unless echo suppression is enabled
+
+	ackTimeouts atomic.Uint64 // messages not acknowledged within the AckTimeout
+	deadLetters atomic.Uint64 // messages dead-lettered
+
+	handlerErrors  atomic.Uint64 // errors returned by MessageHandlerE's
+	handlerRetries atomic.Uint64 // MessageHandlerE retries
+
+	held heldInbound // QoS 2 messages awaiting PUBREL (see Qos2DeliverOnPubrel)
+
+	authMinWait time.Duration // minimum time before reconnecting to refresh credentials (authRefreshMinWait)
+
+	shuttingDown atomic.Bool // set by Shutdown (Publish will fail)
+	storeOpen    atomic.Bool // true from Connect until the final disconnect (whilst c.persist is open)
+
+	closed   atomic.Bool    // set by Close (the client cannot be reconnected)
+	routines sync.WaitGroup // goroutines, other than workers, that may outlive a connection (see Close)
+
+	callbacks callbackQueue // PublishAsync callbacks awaiting execution
+	local     callbackQueue // locally delivered messages awaiting their handlers (see SetLocalDelivery)
+
+	dedupInFlight map[string]struct{} // keys of messages being processed by ExactlyOnce handlers
+	dedupMu       sync.Mutex
+	duplicates    atomic.Uint64 // duplicate messages dropped by ExactlyOnce
 }
 
 // NewClient will create an MQTT v3.1.1 client with all of the options specified
@@ -168,10 +288,20 @@ func NewClient(o *ClientOptions) Client {
 	c.persist = c.options.Store
 	c.messageIds = messageIds{index: make(map[uint16]tokenCompletor)}
 	c.msgRouter = newRouter()
+	c.msgRouter.params = c.options.RouteParams
 	c.msgRouter.setDefaultHandler(c.options.DefaultPublishHandler)
 	c.obound = make(chan *PacketAndToken)
 	c.oboundP = make(chan *PacketAndToken)
 	c.backoff = newBackoffController()
+	if window := c.options.EchoSuppressionWindow; window > 0 || c.options.LocalDelivery {
+		if window <= 0 {
+			window = defaultEchoWindow
+		}
+		c.echoes = newEchoTracker(window)
+	}
+	c.dedupInFlight = make(map[string]struct{})
+	c.held.ids = make(map[uint16]bool)
+	c.authMinWait = authRefreshMinWait
 	return c
 }
 
@@ -184,9 +314,27 @@ func NewClient(o *ClientOptions) Client {
 // a new go routine.
 // callback must be safe for concurrent use by multiple goroutines.
 func (c *client) AddRoute(topic string, callback MessageHandler) {
-	if callback != nil {
-		c.msgRouter.addRoute(topic, callback)
+	c.AddRouteWithMiddleware(topic, callback)
+}
+
+// AddRouteWithMiddleware is equivalent to AddRoute but the callback will be wrapped with the
+// middleware provided (in addition to any added with Use). Routes denied by the TopicPolicy are
+// not added.
+func (c *client) AddRouteWithMiddleware(topic string, callback MessageHandler, middleware ...MessageMiddleware) {
+	if callback == nil {
+		return
+	}
+	if filter, _ := c.msgRouter.routePattern(topic); c.checkSubscribePolicy("route", filter, 0) != nil {
+		return // the denial has been logged
 	}
+	c.msgRouter.addRoute(topic, callback, middleware...)
+}
+
+// Use adds middleware that will be applied to every message handler (including the default
+// handler). Middleware is applied in the order provided (the first will be called first) and
+// wraps any route specific middleware.
+func (c *client) Use(middleware ...MessageMiddleware) {
+	c.msgRouter.use(middleware...)
 }
 
 // IsConnected returns a bool signifying whether
@@ -230,6 +378,11 @@ func (c *client) Connect() Token {
 	t := newToken(packets.Connect).(*ConnectToken)
 	DEBUG.Println(CLI, "Connect()")
 
+	if c.closed.Load() {
+		t.setError(ErrClientClosed)
+		return t
+	}
+
 	connectionUp, err := c.status.Connecting()
 	if err != nil {
 		if err == errAlreadyConnectedOrReconnecting && c.options.AutoReconnect {
@@ -244,12 +397,15 @@ func (c *client) Connect() Token {
 		return t
 	}
 
+	c.shuttingDown.Store(false) // the client may be reused following Shutdown
 	c.persist.Open()
+	c.openDeadLetterStore()
+	c.storeOpen.Store(true)
 	if c.options.ConnectRetry {
 		c.reserveStoredPublishIDs() // Reserve IDs to allow publishing before connect complete
 	}
 
-	go func() {
+	c.goTracked(func() {
 		if len(c.options.Servers) == 0 {
 			t.setError(fmt.Errorf("no servers defined to connect to"))
 			if err := connectionUp(false); err != nil {
@@ -273,7 +429,9 @@ func (c *client) Connect() Token {
 				}
 			}
 			ERROR.Println(CLI, "Failed to connect to a broker")
+			c.storeOpen.Store(false)
 			c.persist.Close()
+			c.closeDeadLetterStore()
 			t.returnCode = rc
 			t.setError(err)
 			if err := connectionUp(false); err != nil {
@@ -296,7 +454,7 @@ func (c *client) Connect() Token {
 		close(inboundFromStore)
 		t.flowComplete()
 		DEBUG.Println(CLI, "exit startClient")
-	}()
+	})
 	return t
 }
 
@@ -365,12 +523,26 @@ func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
 	c.optionsMu.Unlock()
 	for _, broker := range brokers {
 		cm := newConnectMsgFromOptions(&c.options, broker)
+		authRefresh := false // set if credentials from the AuthProvider have been rejected
+		var authExpiry time.Time
 		DEBUG.Println(CLI, "about to write new connect msg")
 	CONN:
+		if c.options.AuthProvider != nil {
+			if authExpiry, err = applyAuthProvider(cm, c.options.AuthProvider, authRefresh); err != nil {
+				ERROR.Println(CLI, "auth provider failed:", err)
+				WARN.Println(CLI, "failed to connect to broker, trying next")
+				rc = packets.ErrNetworkError
+				continue
+			}
+		}
 		tlsCfg := c.options.TLSConfig
+		var tlsConnected func() // called if the connection is established using certificates from the TLSReloader
+		if c.options.TLSReloader != nil {
+			tlsCfg, tlsConnected = c.options.TLSReloader.connectionConfig(tlsCfg)
+		}
 		if c.options.OnConnectAttempt != nil {
 			DEBUG.Println(CLI, "using custom onConnectAttempt handler...")
-			tlsCfg = c.options.OnConnectAttempt(broker, c.options.TLSConfig)
+			tlsCfg = c.options.OnConnectAttempt(broker, tlsCfg)
 		}
 		connDeadline := time.Now().Add(c.options.ConnectTimeout) // Time by which connection must be established
 		dialer := c.options.Dialer
@@ -382,7 +554,7 @@ func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
 		if c.options.CustomOpenConnectionFn != nil {
 			conn, err = c.options.CustomOpenConnectionFn(broker, c.options)
 		} else {
-			conn, err = openConnection(broker, tlsCfg, c.options.ConnectTimeout, c.options.HTTPHeaders, c.options.WebsocketOptions, dialer)
+			conn, err = openConnection(broker, tlsCfg, c.options.ConnectTimeout, c.options.HTTPHeaders, c.options.WebsocketOptions, dialer, c.options.Proxy)
 		}
 		if err != nil {
 			ERROR.Println(CLI, err.Error())
@@ -403,12 +575,22 @@ func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
 			if err := conn.SetDeadline(time.Time{}); err != nil {
 				ERROR.Println(CLI, "reset deadline following handshake ", err)
 			}
+			if tlsConnected != nil {
+				tlsConnected()
+			}
+			c.authExpiry.Store(authExpiry)
 			break // successfully connected
 		}
 
 		// We may have to attempt the connection with MQTT 3.1
 		_ = conn.Close()
 
+		if c.options.AuthProvider != nil && !authRefresh && isAuthRejection(rc) {
+			WARN.Println(CLI, "credentials rejected by", broker, "retrying with refreshed credentials")
+			authRefresh = true
+			goto CONN
+		}
+
 		if !c.options.protocolVersionExplicit && protocolVersion == 4 { // try falling back to 3.1?
 			DEBUG.Println(CLI, "Trying reconnect using MQTT 3.1 protocol")
 			protocolVersion = 3
@@ -425,9 +607,12 @@ func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
 	} else {
 		// Maintain same error format as used previously
 		if rc != packets.ErrNetworkError { // mqtt error
-			err = packets.ConnErrors[rc]
+			err = connackError(rc)
 		} else { // network error (if this occurred in ConnectMQTT then err will be nil)
-			err = fmt.Errorf("%w : %w", packets.ConnErrors[rc], err)
+			var ne *NetworkError
+			if !errors.As(err, &ne) {
+				err = &NetworkError{Err: err}
+			}
 		}
 	}
 	return conn, rc, sessionPresent, err
@@ -438,10 +623,19 @@ func (c *client) attemptConnection() (net.Conn, byte, bool, error) {
 // completed.
 // WARNING: `Disconnect` may return before all activities (goroutines) have completed. This means that
 // reusing the `client` may lead to panics. If you want to reconnect when the connection drops then use
-// `SetAutoReconnect` and/or `SetConnectRetry`options instead of implementing this yourself.
+// `SetAutoReconnect` and/or `SetConnectRetry`options instead of implementing this yourself. Use `Close` if
+// you need to be sure that all goroutines have exited.
 func (c *client) Disconnect(quiesce uint) {
-	done := make(chan struct{}) // Simplest way to ensure quiesce is always honoured
-	go func() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancel()
+	c.disconnectCtx(ctx)
+}
+
+// disconnectCtx sends DISCONNECT and closes the connection; it returns when this is complete or ctx expires (at
+// which point the connection will be closed whether or not DISCONNECT has been sent)
+func (c *client) disconnectCtx(ctx context.Context) {
+	done := make(chan struct{}) // Simplest way to ensure the deadline is always honoured
+	c.goTracked(func() {
 		defer close(done)
 		disDone, err := c.status.Disconnecting()
 		if err != nil {
@@ -452,33 +646,33 @@ func (c *client) Disconnect(quiesce uint) {
 		defer func() {
 			c.disconnect() // Force disconnection
 			disDone()      // Update status
+			c.closeChanSubscriptions()
 		}()
 		DEBUG.Println(CLI, "disconnecting")
 		dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
 		dt := newToken(packets.Disconnect)
 		select {
 		case c.oboundP <- &PacketAndToken{p: dm, t: dt}:
-			// wait for work to finish, or quiesce time consumed
-			DEBUG.Println(CLI, "calling WaitTimeout")
-			dt.WaitTimeout(time.Duration(quiesce) * time.Millisecond)
-			DEBUG.Println(CLI, "WaitTimeout done")
+			// wait for work to finish, or deadline reached
+			DEBUG.Println(CLI, "waiting for DISCONNECT to be sent")
+			select {
+			case <-dt.Done():
+			case <-ctx.Done():
+			}
+			DEBUG.Println(CLI, "wait done")
 		// Below code causes a potential data race. Following status refactor it should no longer be required
 		// but leaving in as need to check code further.
 		// case <-c.commsStopped:
 		//           WARN.Println("Disconnect packet could not be sent because comms stopped")
-		case <-time.After(time.Duration(quiesce) * time.Millisecond):
+		case <-ctx.Done():
 			WARN.Println("Disconnect packet not sent due to timeout")
 		}
-	}()
+	})
 
-	// Return when done or after timeout expires (would like to change but this maintains compatibility)
-	delay := time.NewTimer(time.Duration(quiesce) * time.Millisecond)
+	// Return when done or after deadline reached (would like to change but this maintains compatibility)
 	select {
 	case <-done:
-		if !delay.Stop() {
-			<-delay.C
-		}
-	case <-delay.C:
+	case <-ctx.Done():
 	}
 }
 
@@ -503,7 +697,9 @@ func (c *client) disconnect() {
 		DEBUG.Println(CLI, "forcefully disconnecting")
 		c.messageIds.cleanUp()
 		DEBUG.Println(CLI, "disconnected")
+		c.storeOpen.Store(false)
 		c.persist.Close()
+		c.closeDeadLetterStore()
 	}
 }
 
@@ -522,6 +718,9 @@ func (c *client) internalConnLost(whyConnLost error) {
 		ERROR.Println(CLI, fmt.Sprintf("internalConnLost unexpected status: %s", err.Error()))
 		return
 	}
+	if why := c.reconnectReason.Swap(nil); why != nil { // the broker may close the connection before we do
+		whyConnLost = *why
+	}
 
 	// c.stopCommsWorker returns a channel that is closed when the operation completes. This was required prior
 	// to the implementation of proper status management but has been left in place, for now, to minimise change
@@ -539,7 +738,7 @@ func (c *client) internalConnLost(whyConnLost error) {
 	}
 
 	// It may take a while for the disconnection to complete whatever called us needs to exit cleanly so finnish in goRoutine
-	go func() {
+	c.goTracked(func() {
 		DEBUG.Println(CLI, "internalConnLost waiting on workers")
 		<-stopDone
 		DEBUG.Println(CLI, "internalConnLost workers stopped")
@@ -559,13 +758,43 @@ func (c *client) internalConnLost(whyConnLost error) {
 			c.messageIds.cleanUpSubscribe() // completes SUB/UNSUB tokens
 		}
 		if reconnect {
-			go c.reconnect(reConnDone) // Will set connection status to reconnecting
+			c.goTracked(func() { c.reconnect(reConnDone) }) // Will set connection status to reconnecting
+		} else {
+			c.closeChanSubscriptions()
 		}
 		if c.options.OnConnectionLost != nil {
-			go c.options.OnConnectionLost(c, whyConnLost)
+			c.goTracked(func() { c.options.OnConnectionLost(c, whyConnLost) })
 		}
 		DEBUG.Println(CLI, "internalConnLost complete")
-	}()
+	})
+}
+
+// reconnectGracefully sends a DISCONNECT (so the broker will not publish the will) and then drops the connection,
+// allowing the automatic reconnect logic to establish a new connection (e.g. to pick up new credentials).
+// whyReconnect will be passed to the ConnectionLostHandler.
+// Note: This should only be called from a worker (as it needs c.stop to remain valid)
+func (c *client) reconnectGracefully(whyReconnect error) {
+	if !c.options.AutoReconnect {
+		WARN.Println(CLI, "unable to reconnect (AutoReconnect disabled):", whyReconnect)
+		return
+	}
+	DEBUG.Println(CLI, "reconnecting:", whyReconnect)
+	c.reconnectReason.Store(&whyReconnect)
+	dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	dt := newToken(packets.Disconnect)
+	quiesce := c.options.WriteTimeout
+	if quiesce == 0 {
+		quiesce = 5 * time.Second
+	}
+	select {
+	case c.oboundP <- &PacketAndToken{p: dm, t: dt}:
+		dt.WaitTimeout(quiesce)
+	case <-c.stop:
+		return // connection already being shutdown
+	case <-time.After(quiesce):
+		WARN.Println(CLI, "Disconnect packet not sent due to timeout")
+	}
+	c.internalConnLost(whyReconnect)
 }
 
 // startCommsWorkers is called when the connection is up.
@@ -587,6 +816,7 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 	c.conn = conn // Store the connection
 
 	c.stop = make(chan struct{})
+	c.reconnectReason.Store(nil)
 	if c.options.KeepAlive != 0 {
 		atomic.StoreInt32(&c.pingOutstanding, 0)
 		c.lastReceived.Store(time.Now())
@@ -595,6 +825,16 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 		go keepalive(c, conn)
 	}
 
+	if r := c.options.TLSReloader; r != nil && r.checkInterval > 0 {
+		c.workers.Add(1)
+		go watchTLSReloader(c, r)
+	}
+
+	if exp, _ := c.authExpiry.Load().(time.Time); c.options.AuthProvider != nil && !exp.IsZero() {
+		c.workers.Add(1)
+		go watchAuthExpiry(c, exp)
+	}
+
 	// matchAndDispatch will process messages received from the network. It may generate acknowledgements
 	// It will complete when incomingPubChan is closed and will close ackOut prior to exiting
 	incomingPubChan := make(chan *packets.PublishPacket)
@@ -611,7 +851,7 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 
 	DEBUG.Println(CLI, "client is connected/reconnected")
 	if c.options.OnConnect != nil {
-		go c.options.OnConnect(c)
+		c.goTracked(func() { c.options.OnConnect(c) })
 	}
 
 	// c.oboundP and c.obound need to stay active for the life of the client because, depending upon the options,
@@ -652,9 +892,12 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 		}
 	}()
 
+	if c.options.Qos2DeliverOnPubrel {
+		c.loadHeldInbound()
+	}
 	commsIncomingPub, commsErrors := startComms(c.conn, c, inboundFromStore, commsoboundP, commsobound)
 	c.commsStopped = make(chan struct{})
-	go func() {
+	c.goTracked(func() {
 		for {
 			if commsIncomingPub == nil && commsErrors == nil {
 				break
@@ -695,7 +938,7 @@ func (c *client) startCommsWorkers(conn net.Conn, connectionUp connCompletedFn,
 		}
 		DEBUG.Println(CLI, "incoming comms goroutine done")
 		close(c.commsStopped)
-	}()
+	})
 	DEBUG.Println(CLI, "startCommsWorkers done")
 	return true
 }
@@ -728,7 +971,7 @@ func (c *client) stopCommsWorkers() chan struct{} {
 
 	doneChan := make(chan struct{})
 
-	go func() {
+	c.goTracked(func() {
 		DEBUG.Println(CLI, "stopCommsWorkers waiting for workers")
 		c.workers.Wait()
 
@@ -738,7 +981,7 @@ func (c *client) stopCommsWorkers() chan struct{} {
 
 		DEBUG.Println(CLI, "stopCommsWorkers done")
 		close(doneChan)
-	}()
+	})
 	return doneChan
 }
 
@@ -746,15 +989,22 @@ func (c *client) stopCommsWorkers() chan struct{} {
 // to the specified topic.
 // Returns a token to track delivery of the message to the broker
 func (c *client) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
-	token := newToken(packets.Publish).(*PublishToken)
+	return c.publish(topic, qos, retained, payload, newToken(packets.Publish).(*PublishToken))
+}
+
+// publish implements Publish, completing token when the publish completes
+func (c *client) publish(topic string, qos byte, retained bool, payload interface{}, token *PublishToken) Token {
 	DEBUG.Println(CLI, "enter Publish")
-	switch {
-	case !c.IsConnected():
-		token.setError(ErrNotConnected)
+	if c.shuttingDown.Load() {
+		token.setError(ErrShuttingDown)
 		return token
-	case c.status.ConnectionStatus() == reconnecting && qos == 0:
-		// message written to store and will be sent when connection comes up
-		token.flowComplete()
+	}
+	if err := validatePublishTopic(topic); err != nil {
+		token.setError(err)
+		return token
+	}
+	if err := c.checkPublishPolicy(topic, qos, retained); err != nil {
+		token.setError(err)
 		return token
 	}
 	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
@@ -772,6 +1022,18 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 		token.setError(fmt.Errorf("unknown payload type"))
 		return token
 	}
+	if c.options.LocalDelivery {
+		c.msgRouter.deliverLocal(c, pub)
+	}
+	switch {
+	case !c.IsConnected():
+		token.setError(ErrNotConnected)
+		return token
+	case c.status.ConnectionStatus() == reconnecting && qos == 0:
+		// message written to store and will be sent when connection comes up
+		token.flowComplete()
+		return token
+	}
 
 	if pub.Qos != 0 && pub.MessageID == 0 {
 		mID := c.getID(token)
@@ -783,6 +1045,10 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 		token.messageID = mID
 	}
 	persistOutbound(c.persist, pub)
+	if c.echoes != nil {
+		// Recorded before the message is queued so that an echo cannot arrive first (forgotten if not queued)
+		c.echoes.record(pub.TopicName, pub.Payload)
+	}
 	switch c.status.ConnectionStatus() {
 	case connecting:
 		DEBUG.Println(CLI, "storing publish message (connecting), topic:", topic)
@@ -803,7 +1069,10 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 		select {
 		case c.obound <- &PacketAndToken{p: pub, t: token}:
 		case <-t.C:
-			token.setError(errors.New("publish was broken by timeout"))
+			if c.echoes != nil {
+				c.echoes.forget(pub.TopicName, pub.Payload)
+			}
+			token.setError(fmt.Errorf("publish was broken by timeout: %w", ErrWriteTimeout))
 		}
 	}
 	return token
@@ -817,6 +1086,12 @@ func (c *client) Publish(topic string, qos byte, retained bool, payload interfac
 // a new go routine.
 // callback must be safe for concurrent use by multiple goroutines.
 func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Token {
+	return c.subscribe(topic, qos, callback, nil)
+}
+
+// subscribe sends a SUBSCRIBE for topic; the route added will belong to owner if it is not nil
+// (otherwise callback will replace any existing route for the topic).
+func (c *client) subscribe(topic string, qos byte, callback MessageHandler, owner *Subscription) Token {
 	token := newToken(packets.Subscribe).(*SubscribeToken)
 	DEBUG.Println(CLI, "enter Subscribe")
 	if !c.IsConnected() {
@@ -836,24 +1111,37 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 		}
 	}
 	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	pattern := topic
+	topic, _ = c.msgRouter.routePattern(topic) // the route pattern may contain named parameters
 	if err := validateTopicAndQos(topic, qos); err != nil {
 		token.setError(err)
 		return token
 	}
+	if err := c.checkSubscribePolicy("subscribe", topic, qos); err != nil {
+		token.setError(err)
+		return token
+	}
+	if owner == nil {
+		qos = c.holdPlain(topic, qos)
+	}
 	sub.Topics = append(sub.Topics, topic)
 	sub.Qoss = append(sub.Qoss, qos)
 
-	if strings.HasPrefix(topic, "$share/") {
-		topic = strings.Join(strings.Split(topic, "/")[2:], "/")
+	if strings.HasPrefix(pattern, "$share/") {
+		pattern = strings.Join(strings.Split(pattern, "/")[2:], "/")
 	}
 
-	if strings.HasPrefix(topic, "$queue/") {
-		topic = strings.TrimPrefix(topic, "$queue/")
+	if strings.HasPrefix(pattern, "$queue/") {
+		pattern = strings.TrimPrefix(pattern, "$queue/")
 	}
 
-	if callback != nil {
-		c.msgRouter.addRoute(topic, callback)
+	switch {
+	case owner != nil:
+		c.msgRouter.addSubscriptionRoute(pattern, owner)
+	case callback != nil:
+		c.msgRouter.addRoute(pattern, callback)
 	}
+	topic, _ = c.msgRouter.routePattern(pattern)
 
 	token.subs = append(token.subs, topic)
 
@@ -887,7 +1175,7 @@ func (c *client) Subscribe(topic string, qos byte, callback MessageHandler) Toke
 		select {
 		case c.oboundP <- &PacketAndToken{p: sub, t: token}:
 		case <-time.After(subscribeWaitTimeout):
-			token.setError(errors.New("subscribe was broken by timeout"))
+			token.setError(fmt.Errorf("subscribe was broken by timeout: %w", ErrWriteTimeout))
 		}
 	}
 	DEBUG.Println(CLI, "exit Subscribe")
@@ -922,10 +1210,24 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 		}
 	}
 	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
-	if sub.Topics, sub.Qoss, err = validateSubscribeMap(filters); err != nil {
+	translated := make(map[string]byte, len(filters)) // route patterns may contain named parameters
+	for pattern, qos := range filters {
+		topic, _ := c.msgRouter.routePattern(pattern)
+		translated[topic] = qos
+	}
+	if sub.Topics, sub.Qoss, err = validateSubscribeMap(translated); err != nil {
 		token.setError(err)
 		return token
 	}
+	for i, topic := range sub.Topics {
+		if err = c.checkSubscribePolicy("subscribe", topic, sub.Qoss[i]); err != nil {
+			token.setError(err)
+			return token
+		}
+	}
+	for i, topic := range sub.Topics {
+		sub.Qoss[i] = c.holdPlain(topic, sub.Qoss[i])
+	}
 
 	if callback != nil {
 		for topic := range filters {
@@ -963,7 +1265,7 @@ func (c *client) SubscribeMultiple(filters map[string]byte, callback MessageHand
 		select {
 		case c.oboundP <- &PacketAndToken{p: sub, t: token}:
 		case <-time.After(subscribeWaitTimeout):
-			token.setError(errors.New("subscribe was broken by timeout"))
+			token.setError(fmt.Errorf("subscribe was broken by timeout: %w", ErrWriteTimeout))
 		}
 	}
 	DEBUG.Println(CLI, "exit SubscribeMultiple")
@@ -978,12 +1280,18 @@ func (c *client) reserveStoredPublishIDs() {
 	if !c.options.CleanSession {
 		storedKeys := c.persist.All()
 		for _, key := range storedKeys {
+			if isKeyQuarantined(key) || !isKeyOutbound(key) {
+				continue
+			}
 			packet := c.persist.Get(key)
 			if packet == nil {
 				continue
 			}
 			switch packet.(type) {
 			case *packets.PublishPacket:
+				if validateStoredPacket(packet) != nil { // will be quarantined by resume (so the ID would never be freed)
+					continue
+				}
 				details := packet.Details()
 				token := &PlaceHolderToken{id: details.MessageID}
 				c.claimID(token, details.MessageID)
@@ -1011,28 +1319,32 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 		ctx, cancel := context.WithCancel(context.Background()) // Context needed for semaphore
 		defer cancel()                                          // ensure context gets cancelled
 
-		go func() {
+		stop := c.stop // c.stop will be replaced if a new connection is established before this goroutine runs
+		c.goTracked(func() {
 			select {
-			case <-c.stop: // Request to stop (due to comm error etc)
+			case <-stop: // Request to stop (due to comm error etc)
 				cancel()
 			case <-ctx.Done(): // resume completed normally
 			}
-		}()
+		})
 
 		getSemaphore = func() { sem.Acquire(ctx, 1) }
 		releaseSemaphore = func(token *PublishToken) { // Note: If token never completes then resume() may stall (will still exit on ctx.Done())
-			go func() {
+			c.goTracked(func() {
 				select {
 				case <-token.Done():
 				case <-ctx.Done():
 				}
 				sem.Release(1)
-			}()
+			})
 		}
 	}
 
 	storedKeys := c.persist.All()
 	for _, key := range storedKeys {
+		if isKeyQuarantined(key) {
+			continue
+		}
 		packet := c.persist.Get(key)
 		if packet == nil {
 			DEBUG.Println(STR, fmt.Sprintf("resume found NIL packet (%s)", key))
@@ -1040,6 +1352,10 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 		}
 		details := packet.Details()
 		if isKeyOutbound(key) {
+			if err := validateStoredPacket(packet); err != nil { // resending would lead to the broker dropping the connection
+				quarantine(c.persist, key, packet, err)
+				continue
+			}
 			switch p := packet.(type) {
 			case *packets.SubscribePacket:
 				if subscription {
@@ -1107,7 +1423,12 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 				c.persist.Del(key)
 			}
 		} else {
-			switch packet.(type) {
+			switch p := packet.(type) {
+			case *packets.PublishPacket:
+				if p.Qos != 2 || !c.options.Qos2DeliverOnPubrel {
+					ERROR.Println(STR, fmt.Sprintf("invalid message type (%T) in store (discarded)", packet))
+					c.persist.Del(key)
+				} // otherwise held until PUBREL received (see loadHeldInbound)
 			case *packets.PubrelPacket:
 				DEBUG.Println(STR, fmt.Sprintf("loaded pending incomming (%d)", details.MessageID))
 				select {
@@ -1129,6 +1450,12 @@ func (c *client) resume(subscription bool, ibound chan packets.ControlPacket) {
 // Messages published to those topics from other clients will no longer be
 // received.
 func (c *client) Unsubscribe(topics ...string) Token {
+	return c.unsubscribe(true, topics...)
+}
+
+// unsubscribe sends an UNSUBSCRIBE for topics; if deleteRoutes is true the routes for the topics
+// are removed once the packet has been queued
+func (c *client) unsubscribe(deleteRoutes bool, topics ...string) Token {
 	token := newToken(packets.Unsubscribe).(*UnsubscribeToken)
 	DEBUG.Println(CLI, "enter Unsubscribe")
 	if !c.IsConnected() {
@@ -1149,7 +1476,18 @@ func (c *client) Unsubscribe(topics ...string) Token {
 	}
 	unsub := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
 	unsub.Topics = make([]string, len(topics))
-	copy(unsub.Topics, topics)
+	for i, topic := range topics {
+		unsub.Topics[i], _ = c.msgRouter.routePattern(topic) // topics may be route patterns
+	}
+	if deleteRoutes { // Filters still held by Subscription handles remain subscribed (only the routes are removed)
+		if unsub.Topics = c.releasePlain(unsub.Topics); len(unsub.Topics) == 0 {
+			for _, topic := range topics {
+				c.msgRouter.deleteRoute(topic)
+			}
+			token.flowComplete()
+			return token
+		}
+	}
 
 	if unsub.MessageID == 0 {
 		mID := c.getID(token)
@@ -1180,11 +1518,13 @@ func (c *client) Unsubscribe(topics ...string) Token {
 		}
 		select {
 		case c.oboundP <- &PacketAndToken{p: unsub, t: token}:
-			for _, topic := range topics {
-				c.msgRouter.deleteRoute(topic)
+			if deleteRoutes {
+				for _, topic := range topics {
+					c.msgRouter.deleteRoute(topic)
+				}
 			}
 		case <-time.After(subscribeWaitTimeout):
-			token.setError(errors.New("unsubscribe was broken by timeout"))
+			token.setError(fmt.Errorf("unsubscribe was broken by timeout: %w", ErrWriteTimeout))
 		}
 	}
 
@@ -1232,6 +1572,9 @@ func (c *client) persistOutbound(m packets.ControlPacket) {
 
 // persistInbound adds the packet to the inbound store
 func (c *client) persistInbound(m packets.ControlPacket) {
+	if _, ok := m.(*packets.PubrelPacket); ok && c.options.Qos2DeliverOnPubrel && c.isHeld(m.Details().MessageID) {
+		return // the PUBLISH remains in the store until PUBCOMP is sent
+	}
 	persistInbound(c.persist, m)
 }
 
@@ -0,0 +1,77 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Client lifecycle
+//
+// A client created by NewClient may be connected and disconnected any number of times. Whilst connected (or
+// connecting/reconnecting) the client runs a number of goroutines; these are:
+//   - the comms goroutines (reading from and writing to the network connection),
+//   - the workers (keepalive, TLS/credential watchers and the goroutine passing messages to the router),
+//   - goroutines that may outlive a connection: message handlers (and the goroutines waiting on them), dispatch
+//     workers, OnConnect/OnConnectionLost and PublishAsync callbacks, the reconnect loop and those used whilst
+//     resuming a session.
+//
+// Disconnect stops the first two groups before returning, but does not wait for the last (e.g. a message handler
+// that has not returned). Close disconnects and then waits until every goroutine started by the client has exited;
+// once it returns the client holds no goroutines, outstanding tokens have been completed (with an error) and the
+// client may be garbage collected. A closed client cannot be reconnected (Connect returns ErrClientClosed).
+
+// ErrClientClosed is returned by Connect (and Close) once Close has been called
+var ErrClientClosed = errors.New("client is closed")
+
+// closeDisconnectTimeout is the time Close allows for DISCONNECT to be sent if WriteTimeout is not set
+const closeDisconnectTimeout = 5 * time.Second
+
+// Close disconnects from the broker (if connected) and blocks until every goroutine started by the client has
+// exited. This includes message handlers so Close will not return whilst a handler is blocked (use Shutdown first
+// if handlers need to be given a deadline). Any tokens still outstanding are completed with an error. The client
+// cannot be used after Close is called (Connect will return ErrClientClosed).
+//
+// Close must not be called from a message handler or callback (it would wait for itself).
+func (c *client) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return ErrClientClosed
+	}
+	DEBUG.Println(CLI, "closing")
+	timeout := c.options.WriteTimeout
+	if timeout == 0 {
+		timeout = closeDisconnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	c.disconnectCtx(ctx) // no-op if already disconnected
+	cancel()
+
+	c.routines.Wait()
+	c.messageIds.cleanUp() // tokens held following a connection loss (as the session may have been resumed)
+	c.routines.Wait()      // PublishAsync callbacks for the tokens completed above
+	c.closeChanSubscriptions()
+	DEBUG.Println(CLI, "closed")
+	return nil
+}
+
+// goTracked runs f in a new goroutine that Close will wait for
+func (c *client) goTracked(f func()) {
+	c.routines.Add(1)
+	go func() {
+		defer c.routines.Done()
+		f()
+	}()
+}
@@ -0,0 +1,165 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// deadLetterPrefix is the prefix of the keys used in the dead-letter Store (keys are "dl.{time}-{n}.{message id}"
+// so that mIDFromKey can be used)
+const deadLetterPrefix = "dl."
+
+// DeadLetterReason indicates why a message was dead-lettered
+type DeadLetterReason string
+
+const (
+	// DeadLetterUnroutable means no route matched the message and there is no default handler
+	DeadLetterUnroutable DeadLetterReason = "unroutable"
+	// DeadLetterHandlerPanic means a handler panicked whilst processing the message
+	DeadLetterHandlerPanic DeadLetterReason = "handler panic"
+	// DeadLetterHandlerError means a MessageHandlerE returned an error (see HandlerErrorDeadLetter)
+	DeadLetterHandlerError DeadLetterReason = "handler error"
+)
+
+// DeadLetter holds a message that could not be processed along with the reason; it is the JSON encoding of this
+// that is published to the dead-letter topic and written to the dead-letter store.
+type DeadLetter struct {
+	Topic     string           `json:"topic"`
+	Qos       byte             `json:"qos"`
+	Retained  bool             `json:"retained"`
+	MessageID uint16           `json:"messageId"`
+	Payload   []byte           `json:"payload"`
+	Reason    DeadLetterReason `json:"reason"`
+	Error     string           `json:"error,omitempty"`
+	Time      time.Time        `json:"time"`
+	Key       string           `json:"-"` // key in the dead-letter store (set by LoadDeadLetters)
+}
+
+// DeadLetterHandler is invoked when a message is dead-lettered (see SetDeadLetterHandler)
+type DeadLetterHandler func(client Client, dl *DeadLetter)
+
+// LoadDeadLetters returns the messages in a dead-letter store (see SetDeadLetterStore) ordered by the time they
+// were dead-lettered. Entries can be removed from the store with s.Del(dl.Key).
+func LoadDeadLetters(s Store) ([]*DeadLetter, error) {
+	var dls []*DeadLetter
+	for _, key := range s.All() {
+		if !strings.HasPrefix(key, deadLetterPrefix) {
+			continue
+		}
+		p, ok := s.Get(key).(*packets.PublishPacket)
+		if !ok {
+			return nil, fmt.Errorf("dead-letter store entry %s is not a PUBLISH packet", key)
+		}
+		dl := &DeadLetter{}
+		if err := json.Unmarshal(p.Payload, dl); err != nil {
+			return nil, fmt.Errorf("dead-letter store entry %s: %w", key, err)
+		}
+		dl.Key = key
+		dls = append(dls, dl)
+	}
+	sort.SliceStable(dls, func(i, j int) bool { return dls[i].Time.Before(dls[j].Time) })
+	return dls, nil
+}
+
+// deadLetterEnabled returns true if any form of dead-letter handling is configured
+func (c *client) deadLetterEnabled() bool {
+	o := c.options
+	return o.OnDeadLetter != nil || o.DeadLetterTopic != "" || o.DeadLetterStore != nil
+}
+
+// deadLetter passes m to the configured dead-letter handler, topic and store (err may be nil)
+func (c *client) deadLetter(m Message, reason DeadLetterReason, err error) {
+	if !c.deadLetterEnabled() {
+		return
+	}
+	if m.Topic() == c.options.DeadLetterTopic { // republishing would loop
+		ERROR.Println(CLI, "unable to dead-letter message received on the dead-letter topic, reason:", reason)
+		return
+	}
+	dl := &DeadLetter{
+		Topic:     m.Topic(),
+		Qos:       m.Qos(),
+		Retained:  m.Retained(),
+		MessageID: m.MessageID(),
+		Payload:   m.Payload(),
+		Reason:    reason,
+		Time:      time.Now(),
+	}
+	if err != nil {
+		dl.Error = err.Error()
+	}
+	n := c.deadLetters.Add(1)
+	WARN.Println(CLI, "dead-lettering message, topic:", dl.Topic, "id:", dl.MessageID, "reason:", reason)
+	if c.options.DeadLetterStore != nil || c.options.DeadLetterTopic != "" {
+		payload, jErr := json.Marshal(dl)
+		if jErr != nil { // should not happen
+			ERROR.Println(CLI, "unable to encode dead letter:", jErr)
+		} else {
+			if s := c.options.DeadLetterStore; s != nil && !c.storeOpen.Load() {
+				ERROR.Println(CLI, "unable to store dead letter as the client is disconnected")
+			} else if s != nil {
+				p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				p.TopicName, p.Qos, p.MessageID, p.Payload = dl.Topic, dl.Qos, dl.MessageID, payload
+				s.Put(fmt.Sprintf("%s%d-%d.%d", deadLetterPrefix, dl.Time.UnixNano(), n, dl.MessageID), p)
+			}
+			if t := c.options.DeadLetterTopic; t != "" {
+				// This may be called from the goroutine processing incoming messages so the publish (which blocks
+				// until the packet is queued) is made on another goroutine; the token is not waited on as it may
+				// not complete until the client reconnects.
+				c.goTracked(func() {
+					if tok := c.Publish(t, c.options.DeadLetterQos, false, payload); tok.Error() != nil {
+						ERROR.Println(CLI, "unable to publish dead letter:", tok.Error())
+					}
+				})
+			}
+		}
+	}
+	if c.options.OnDeadLetter != nil {
+		c.options.OnDeadLetter(c, dl)
+	}
+}
+
+// openDeadLetterStore opens the DeadLetterStore (if any); it is opened and closed along with the Store set with
+// SetStore
+func (c *client) openDeadLetterStore() {
+	if s := c.options.DeadLetterStore; s != nil {
+		s.Open()
+	}
+}
+
+// closeDeadLetterStore closes the DeadLetterStore (if any)
+func (c *client) closeDeadLetterStore() {
+	if s := c.options.DeadLetterStore; s != nil {
+		s.Close()
+	}
+}
+
+// unroutable handles a message for which there is no handler; it is dead-lettered and then acknowledged or
+// abandoned as per the DeadLetterAck option
+func (c *client) unroutable(m *message) {
+	c.deadLetter(m, DeadLetterUnroutable, nil)
+	if c.options.DeadLetterAck {
+		m.Ack()
+		return
+	}
+	DEBUG.Println(ROU, "matchAndDispatch received message and no handler was available. Message will NOT be acknowledged.")
+	m.abandon()
+}
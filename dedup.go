@@ -0,0 +1,270 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupStore records the messages that have been processed by handlers using the ExactlyOnce middleware. Keys
+// identify a message (they are derived from the client ID, packet ID and a digest of the topic and payload).
+// Implementations must be safe for concurrent use.
+type DedupStore interface {
+	// Contains returns true if key has been added and has not expired
+	Contains(key string) (bool, error)
+	// Add records key; it may be forgotten after expires
+	Add(key string, expires time.Time) error
+}
+
+// dedupPruneThreshold is the number of additions after which expired entries are removed
+const dedupPruneThreshold = 1024
+
+// MemoryDedupStore is a DedupStore held in memory (so duplicates are only detected within the life of the
+// process)
+type MemoryDedupStore struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	added   int // since last prune
+}
+
+// NewMemoryDedupStore returns a new, empty, MemoryDedupStore
+func NewMemoryDedupStore() *MemoryDedupStore {
+	return &MemoryDedupStore{entries: make(map[string]time.Time)}
+}
+
+// Contains returns true if key has been added and has not expired
+func (s *MemoryDedupStore) Contains(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exp, ok := s.entries[key]
+	return ok && time.Now().Before(exp), nil
+}
+
+// Add records key
+func (s *MemoryDedupStore) Add(key string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = expires
+	if s.added++; s.added > dedupPruneThreshold {
+		pruneDedup(s.entries)
+		s.added = 0
+	}
+	return nil
+}
+
+// pruneDedup removes expired entries
+func pruneDedup(entries map[string]time.Time) {
+	now := time.Now()
+	for k, exp := range entries {
+		if !now.Before(exp) {
+			delete(entries, k)
+		}
+	}
+}
+
+// FileDedupStore is a DedupStore persisted to a file (so duplicates are detected across restarts). Entries are
+// appended to the file as they are added; the file is rewritten (without expired entries) when opened and
+// periodically thereafter.
+type FileDedupStore struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	entries map[string]time.Time
+	added   int // since the file was last rewritten
+}
+
+// NewFileDedupStore opens (creating if necessary) the FileDedupStore at path
+func NewFileDedupStore(path string) (*FileDedupStore, error) {
+	s := &FileDedupStore{path: path, entries: make(map[string]time.Time)}
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		err = s.load(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	if err = s.rewrite(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the entries from f; each line is "{expiry (unix nanoseconds)} {quoted key}"
+func (s *FileDedupStore) load(f *os.File) error {
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		exp, key, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return fmt.Errorf("%s:%d: invalid entry", s.path, line)
+		}
+		nanos, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", s.path, line, err)
+		}
+		if key, err = strconv.Unquote(key); err != nil {
+			return fmt.Errorf("%s:%d: %w", s.path, line, err)
+		}
+		s.entries[key] = time.Unix(0, nanos)
+	}
+	return scanner.Err()
+}
+
+// rewrite replaces the file with one containing the unexpired entries (and leaves it open for appending)
+// Note: s.mu must be held (or s not yet shared)
+func (s *FileDedupStore) rewrite() error {
+	pruneDedup(s.entries)
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for key, exp := range s.entries {
+		fmt.Fprintf(w, "%d %s\n", exp.UnixNano(), strconv.Quote(key))
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		return err
+	}
+	if s.f != nil {
+		_ = s.f.Close()
+	}
+	s.f, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	s.added = 0
+	return err
+}
+
+// Contains returns true if key has been added and has not expired
+func (s *FileDedupStore) Contains(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exp, ok := s.entries[key]
+	return ok && time.Now().Before(exp), nil
+}
+
+// Add records key (the entry is written to the file before Add returns)
+func (s *FileDedupStore) Add(key string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	s.entries[key] = expires
+	if s.added++; s.added > dedupPruneThreshold && s.added > len(s.entries) {
+		return s.rewrite()
+	}
+	_, err := fmt.Fprintf(s.f, "%d %s\n", expires.UnixNano(), strconv.Quote(key))
+	return err
+}
+
+// Close closes the file; the store cannot be used after it is closed
+func (s *FileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// ExactlyOnce is a MessageMiddleware that ensures a handler sees each QoS 1 or 2 message once, even if it is
+// redelivered by the broker (e.g. after a reconnect or restart), by recording processed messages in the DedupStore
+// (see SetDedupStore). A message is recorded when the handler returns (unless it panics or passes the message to
+// Nack). Redelivered messages (those with the DUP flag set) that have already been processed are acknowledged
+// without calling the handler; if the original is still being processed the redelivery is not acknowledged (the
+// original's outcome determines whether the message is acknowledged). QoS 0 messages, and all messages if no
+// DedupStore is set, are passed straight through.
+//
+// Messages are identified by the client ID, packet ID, topic and payload. As the broker sets DUP on every
+// redelivery, messages without it are always processed (so a message with the same content that happens to be
+// given a reused packet ID is not mistaken for a duplicate).
+func ExactlyOnce(next MessageHandler) MessageHandler {
+	return func(cl Client, m Message) {
+		c := clientOf(cl)
+		if c == nil || c.options.DedupStore == nil || m.Qos() == 0 {
+			next(cl, m)
+			return
+		}
+		c.exactlyOnce(cl, next, m)
+	}
+}
+
+// dedupKey returns the key used to identify m in the DedupStore
+func (c *client) dedupKey(m Message) string {
+	d := contentDigest(m.Topic(), m.Payload())
+	return fmt.Sprintf("%s/%d/%x", c.options.ClientID, m.MessageID(), d[:16])
+}
+
+// exactlyOnce calls next unless m has already been processed (see ExactlyOnce)
+func (c *client) exactlyOnce(cl Client, next MessageHandler, m Message) {
+	key := c.dedupKey(m)
+	c.dedupMu.Lock()
+	_, inFlight := c.dedupInFlight[key]
+	if !inFlight {
+		c.dedupInFlight[key] = struct{}{}
+	}
+	c.dedupMu.Unlock()
+	if inFlight { // acknowledging now would lose the message if the original is not processed successfully
+		c.duplicates.Add(1)
+		DEBUG.Println(ROU, "duplicate message dropped (in progress), topic:", m.Topic(), "id:", m.MessageID())
+		Nack(m)
+		return
+	}
+	defer func() {
+		c.dedupMu.Lock()
+		delete(c.dedupInFlight, key)
+		c.dedupMu.Unlock()
+	}()
+
+	var seen bool
+	if m.Duplicate() { // only a redelivery can have been processed already
+		var err error
+		if seen, err = c.options.DedupStore.Contains(key); err != nil { // better to risk processing the message twice than not at all
+			ERROR.Println(ROU, "dedup store lookup failed (message will be processed):", err)
+		}
+	}
+	if seen {
+		c.duplicates.Add(1)
+		DEBUG.Println(ROU, "duplicate message dropped, topic:", m.Topic(), "id:", m.MessageID())
+		m.Ack()
+		return
+	}
+	next(cl, m)
+	if nacked(m) {
+		return
+	}
+	if err := c.options.DedupStore.Add(key, time.Now().Add(c.options.DedupWindow)); err != nil {
+		ERROR.Println(ROU, "unable to record message in dedup store:", err)
+	}
+}
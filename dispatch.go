@@ -0,0 +1,201 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dispatchStats holds counters maintained by the router
+type dispatchStats struct {
+	received  atomic.Uint64 // messages received by the router
+	pending   atomic.Int64  // messages read from the network that have not yet been passed to a handler
+	active    atomic.Int64  // handlers currently running
+	queued    atomic.Int64  // handlers waiting for a dispatch worker
+	highWater atomic.Int64  // maximum value of queued
+}
+
+// DispatchKeyFunc returns the key used to select the worker that will process a message when using keyed
+// dispatch (see ClientOptions.SetKeyedDispatch); messages with the same key are processed in the order received.
+type DispatchKeyFunc func(Message) string
+
+// TopicDispatchKey is the default DispatchKeyFunc; messages on the same topic are processed in order
+func TopicDispatchKey(m Message) string {
+	return m.Topic()
+}
+
+// dispatchPool runs message handlers on a fixed number of goroutines (used when order=false and
+// ClientOptions.DispatchWorkers > 0 or when keyed dispatch is in use)
+type dispatchPool struct {
+	queues []chan func() // a single queue shared by all workers or, if keyed, one per worker
+	stats  *dispatchStats
+}
+
+// newDispatchPool starts workers goroutines (using start) that will run the jobs enqueued. If keyed is true each
+// worker has its own queue (so jobs with the same key will run in order), otherwise the workers share a queue. Up to
+// depth jobs may be queued (per queue).
+func newDispatchPool(workers, depth int, keyed bool, stats *dispatchStats, start func(func())) *dispatchPool {
+	p := &dispatchPool{stats: stats}
+	if keyed {
+		p.queues = make([]chan func(), workers)
+		for i := range p.queues {
+			p.queues[i] = make(chan func(), depth)
+			q := p.queues[i]
+			start(func() { p.worker(q) })
+		}
+		return p
+	}
+	q := make(chan func(), depth)
+	p.queues = []chan func(){q}
+	for i := 0; i < workers; i++ {
+		start(func() { p.worker(q) })
+	}
+	return p
+}
+
+// worker runs jobs until the queue is closed
+func (p *dispatchPool) worker(q <-chan func()) {
+	for job := range q {
+		p.stats.queued.Add(-1)
+		job()
+	}
+}
+
+// enqueue adds a job to the queue (selected using key if the pool is keyed); blocking if the queue is full
+func (p *dispatchPool) enqueue(key string, job func()) {
+	q := p.queues[0]
+	if len(p.queues) > 1 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		q = p.queues[h.Sum32()%uint32(len(p.queues))]
+	}
+	n := p.stats.queued.Add(1)
+	for {
+		hw := p.stats.highWater.Load()
+		if n <= hw || p.stats.highWater.CompareAndSwap(hw, n) {
+			break
+		}
+	}
+	q <- job
+}
+
+// stop signals the workers to exit once the queues have been drained; enqueue must not be called after this
+func (p *dispatchPool) stop() {
+	for _, q := range p.queues {
+		close(q)
+	}
+}
+
+// ackSequencer ensures that acknowledgements are sent in the order that the messages were received (as required
+// by the spec) even though the messages may be processed concurrently. If it is not ordered then each ACK is sent
+// when completed (the sequencer is then only used to manage AckTimeout timers).
+type ackSequencer struct {
+	ordered bool
+	mu      sync.Mutex
+	sendMu  sync.Mutex             // held whilst sending so that ACKs released by different goroutines remain in order
+	next    uint64                 // sequence number that will be allocated next
+	release uint64                 // sequence number of the next ACK to be sent
+	pending map[uint64]func()      // completed but not yet released (nil = nothing to send)
+	timers  map[uint64]*time.Timer // AckTimeout timers of messages that have not been completed
+	stopped bool                   // set by stop; the connection has gone so nothing further is released
+}
+
+// newAckSequencer creates a new ackSequencer
+func newAckSequencer(ordered bool) *ackSequencer {
+	return &ackSequencer{ordered: ordered, pending: make(map[uint64]func()), timers: make(map[uint64]*time.Timer)}
+}
+
+// setTimer associates the AckTimeout timer t with seq; it is stopped when seq is completed (or the sequencer is
+// stopped)
+func (s *ackSequencer) setTimer(seq uint64, t *time.Timer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		t.Stop()
+		return
+	}
+	s.timers[seq] = t
+}
+
+// isStopped returns true once stop has been called
+func (s *ackSequencer) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// stop is called when the connection the messages were received on has gone; timers are stopped and any ACKs
+// held (or completed later) are discarded
+func (s *ackSequencer) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for _, t := range s.timers {
+		t.Stop()
+	}
+	s.timers = nil
+	s.pending = nil
+}
+
+// allocate returns the sequence number for a newly received message
+func (s *ackSequencer) allocate() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.next
+	s.next++
+	return seq
+}
+
+// complete records that the message with sequence number seq has been processed. ack (which may be nil if no
+// acknowledgement is to be sent) will be called once all earlier messages have been completed.
+func (s *ackSequencer) complete(seq uint64, ack func()) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	if t, ok := s.timers[seq]; ok {
+		t.Stop()
+		delete(s.timers, seq)
+	}
+	if !s.ordered {
+		s.mu.Unlock()
+		if ack != nil {
+			ack()
+		}
+		return
+	}
+	s.pending[seq] = ack
+	var ready []func()
+	for {
+		a, ok := s.pending[s.release]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.release)
+		s.release++
+		if a != nil {
+			ready = append(ready, a)
+		}
+	}
+	s.sendMu.Lock() // acquired before releasing mu so that ACKs are sent in sequence
+	s.mu.Unlock()
+	defer s.sendMu.Unlock()
+	for _, a := range ready {
+		a()
+	}
+}
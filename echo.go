@@ -0,0 +1,130 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// defaultEchoWindow is used when LocalDelivery is enabled without an EchoSuppressionWindow
+const defaultEchoWindow = 30 * time.Second
+
+// echoTracker records digests of the messages published by the client so that, when the broker sends them back
+// (MQTT 3.1.1 has no No-Local option), they can be recognised and suppressed
+type echoTracker struct {
+	window     time.Duration
+	mu         sync.Mutex
+	pending    map[[sha256.Size]byte][]time.Time // expiry of each outstanding publish (oldest first)
+	suppressed atomic.Uint64
+}
+
+func newEchoTracker(window time.Duration) *echoTracker {
+	return &echoTracker{window: window, pending: make(map[[sha256.Size]byte][]time.Time)}
+}
+
+// contentDigest returns a digest identifying the topic and payload (used to recognise echoes and duplicates)
+func contentDigest(topic string, payload []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(topic))
+	h.Write([]byte{0}) // topics cannot contain U+0000 so this separates the topic from the payload
+	h.Write(payload)
+	var d [sha256.Size]byte
+	h.Sum(d[:0])
+	return d
+}
+
+// record notes that a message has been published
+func (e *echoTracker) record(topic string, payload []byte) {
+	d := contentDigest(topic, payload)
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending[d] = append(e.pending[d], now.Add(e.window))
+	if len(e.pending) > 1024 { // the map is not otherwise cleared of messages that are not echoed back
+		for k, expiries := range e.pending {
+			if now.After(expiries[len(expiries)-1]) {
+				delete(e.pending, k)
+			}
+		}
+	}
+}
+
+// forget removes the most recent record of a publish (used when the publish could not be queued)
+func (e *echoTracker) forget(topic string, payload []byte) {
+	d := contentDigest(topic, payload)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if expiries := e.pending[d]; len(expiries) > 1 {
+		e.pending[d] = expiries[:len(expiries)-1]
+	} else {
+		delete(e.pending, d)
+	}
+}
+
+// consume returns true (and forgets the publish) if the message matches one published within the window
+func (e *echoTracker) consume(topic string, payload []byte) bool {
+	d := contentDigest(topic, payload)
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	expiries := e.pending[d]
+	for len(expiries) > 0 && now.After(expiries[0]) {
+		expiries = expiries[1:]
+	}
+	if len(expiries) == 0 {
+		delete(e.pending, d)
+		return false
+	}
+	if expiries = expiries[1:]; len(expiries) == 0 {
+		delete(e.pending, d)
+	} else {
+		e.pending[d] = expiries
+	}
+	e.suppressed.Add(1)
+	return true
+}
+
+// suppressEcho is the handler used for messages identified as echoes; it only acknowledges the message
+func suppressEcho(_ Client, m Message) {
+	m.Ack()
+}
+
+// deliverLocal queues a message published by the client for delivery to the matching local routes (or the
+// default handler if none match); the message does not need to be acknowledged. Handlers are run, in publish order,
+// on a goroutine managed by the client (see callbackQueue) rather than by Publish; this means that a handler that
+// publishes cannot recurse and a slow handler holds up neither the caller nor messages received from the broker.
+func (r *router) deliverLocal(client *client, p *packets.PublishPacket) {
+	m := messageFromPublish(p, func() {}) // taken now as p is modified (and sent) once Publish proceeds
+	client.local.add(func() {
+		var handlers []MessageHandler
+		r.RLock()
+		for e := r.routes.Front(); e != nil; e = e.Next() {
+			if e.Value.(*route).match(m.topic) {
+				handlers = append(handlers, r.handler(e.Value.(*route)))
+			}
+		}
+		if len(handlers) == 0 && r.defaultHandler != nil {
+			handlers = append(handlers, ChainMiddleware(r.defaultHandler, r.middleware...))
+		}
+		r.RUnlock()
+		for _, h := range handlers {
+			r.invokeHandler(client, h, m)
+		}
+	}, client.goTracked)
+}
@@ -0,0 +1,113 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"time"
+)
+
+// MessageHandlerE is a MessageHandler that reports whether the message was processed successfully; use HandleErrors
+// to convert it into a MessageHandler that can be passed to Subscribe, AddRoute etc.
+type MessageHandlerE func(Client, Message) error
+
+// HandlerErrorHandler is invoked each time a MessageHandlerE returns an error; attempt is 1 for the first call,
+// 2 for the first retry etc.
+type HandlerErrorHandler func(client Client, msg Message, err error, attempt int)
+
+// HandlerErrorPolicy determines what happens to a message when a MessageHandlerE returns an error (and any
+// retries have been exhausted)
+type HandlerErrorPolicy byte
+
+const (
+	// HandlerErrorNoAck does not acknowledge the message (it may be redelivered by the broker when the session is
+	// resumed); the default
+	HandlerErrorNoAck HandlerErrorPolicy = iota
+	// HandlerErrorAck acknowledges the message (as if the handler had succeeded)
+	HandlerErrorAck
+	// HandlerErrorDeadLetter dead-letters the message (see SetDeadLetterHandler); it is then acknowledged if
+	// DeadLetterAck is set
+	HandlerErrorDeadLetter
+)
+
+// HandleErrors returns a MessageHandler that calls h; the message is acknowledged if h returns nil (whether or not
+// AutoAckDisabled is set). If h returns an error, it is passed to the HandlerErrorHandler and h is retried as per
+// SetHandlerRetry; if it still fails the HandlerErrorPolicy is applied.
+//
+// Retries are made from the goroutine that called the handler (so, if OrderMatters is set, no other messages will
+// be processed whilst waiting to retry) and stop if the connection is lost.
+func HandleErrors(h MessageHandlerE) MessageHandler {
+	return func(cl Client, m Message) {
+		c := clientOf(cl)
+		if c == nil { // not one of our clients so options are unavailable
+			if err := h(cl, m); err != nil {
+				ERROR.Println(ROU, "message handler failed, topic:", m.Topic(), "id:", m.MessageID(), "error:", err)
+				Nack(m)
+				return
+			}
+			m.Ack()
+			return
+		}
+		c.handleErrors(cl, h, m)
+	}
+}
+
+// clientOf returns the *client underlying cl (nil if it is not a client created by this package)
+func clientOf(cl Client) *client {
+	switch c := cl.(type) {
+	case *client:
+		return c
+	case *namespacedClient:
+		return c.c
+	}
+	return nil
+}
+
+// handleErrors calls h (retrying as configured) and applies the HandlerErrorPolicy if it fails; cl is the Client
+// passed to h
+func (c *client) handleErrors(cl Client, h MessageHandlerE, m Message) {
+	interval := c.options.HandlerRetryInterval
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = h(cl, m); err == nil {
+			m.Ack()
+			return
+		}
+		c.handlerErrors.Add(1)
+		WARN.Println(ROU, "message handler failed, topic:", m.Topic(), "id:", m.MessageID(), "attempt:", attempt, "error:", err)
+		if c.options.OnHandlerError != nil {
+			c.options.OnHandlerError(cl, m, err, attempt)
+		}
+		if attempt > c.options.HandlerRetries || !c.IsConnectionOpen() {
+			break
+		}
+		c.handlerRetries.Add(1)
+		time.Sleep(interval)
+		if interval *= 2; c.options.HandlerRetryMaxInterval > 0 && interval > c.options.HandlerRetryMaxInterval {
+			interval = c.options.HandlerRetryMaxInterval
+		}
+	}
+	switch c.options.HandlerErrorPolicy {
+	case HandlerErrorAck:
+		m.Ack()
+	case HandlerErrorDeadLetter:
+		c.deadLetter(m, DeadLetterHandlerError, err)
+		if c.options.DeadLetterAck {
+			m.Ack()
+			return
+		}
+		Nack(m)
+	default:
+		Nack(m)
+	}
+}
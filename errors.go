@@ -0,0 +1,136 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// The errors below may be returned (wrapped) by tokens or passed to the ConnectionLostHandler; use errors.Is to
+// check for them (errors.As can be used to retrieve a *NetworkError).
+var (
+	// Errors corresponding to the CONNACK return codes; these are returned unwrapped (as in previous versions) so
+	// may also be compared with ==
+	ErrConnRefusedBadProtocolVersion    = packets.ErrorRefusedBadProtocolVersion
+	ErrConnRefusedIDRejected            = packets.ErrorRefusedIDRejected
+	ErrConnRefusedServerUnavailable     = packets.ErrorRefusedServerUnavailable
+	ErrConnRefusedBadUsernameOrPassword = packets.ErrorRefusedBadUsernameOrPassword
+	ErrConnRefusedNotAuthorised         = packets.ErrorRefusedNotAuthorised
+
+	// ErrNetworkError is wrapped by all NetworkError's
+	ErrNetworkError = packets.ErrorNetworkError
+	// ErrProtocolViolation indicates that the broker sent something unexpected (e.g. an unknown packet type)
+	ErrProtocolViolation = packets.ErrorProtocolViolation
+
+	// ErrPingTimeout is passed to the ConnectionLostHandler when a PINGRESP is not received within the PingTimeout
+	ErrPingTimeout = errors.New("pingresp not received, disconnecting")
+	// ErrWriteTimeout indicates that a packet could not be sent within the WriteTimeout
+	ErrWriteTimeout = errors.New("write timeout")
+	// ErrUnknownProtocol is returned when the broker URL scheme is not supported
+	ErrUnknownProtocol = errors.New("unknown protocol")
+	// ErrConnectionLost is set on tokens that were in flight when the connection was lost
+	ErrConnectionLost = errors.New("connection lost")
+	// ErrHandlerPanic is passed to the ConnectionLostHandler when a handler panics and the HandlerPanicPolicy
+	// is HandlerPanicDisconnect
+	ErrHandlerPanic = errors.New("message handler panicked")
+)
+
+// ConnackError is returned when the broker refuses the connection with a return code that has no corresponding
+// ErrConnRefused* error (for the defined codes that error is returned, see connackError)
+type ConnackError struct {
+	ReturnCode byte
+}
+
+// Error returns the message associated with the return code
+func (e *ConnackError) Error() string {
+	if err := packets.ConnErrors[e.ReturnCode]; err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("unknown CONNACK return code %d", e.ReturnCode)
+}
+
+// Unwrap returns the error associated with the return code
+func (e *ConnackError) Unwrap() error {
+	return packets.ConnErrors[e.ReturnCode]
+}
+
+// connackError returns the error to report when the broker refuses the connection with return code rc
+func connackError(rc byte) error {
+	if err := packets.ConnErrors[rc]; err != nil {
+		return err
+	}
+	return &ConnackError{ReturnCode: rc}
+}
+
+// NetworkError is returned when the network connection could not be established or fails; Err holds the cause
+// (e.g. a net.OpError). Both ErrNetworkError and Err will match with errors.Is.
+type NetworkError struct {
+	Err error
+}
+
+// Error maintains the format used in previous versions ("network Error : cause")
+func (e *NetworkError) Error() string {
+	if e.Err == nil {
+		return ErrNetworkError.Error()
+	}
+	return ErrNetworkError.Error() + " : " + e.Err.Error()
+}
+
+// Unwrap returns ErrNetworkError and the cause
+func (e *NetworkError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{ErrNetworkError}
+	}
+	return []error{ErrNetworkError, e.Err}
+}
+
+// TopicError is returned when a topic name is invalid; Err is one of the errors defined in the topic package (e.g.
+// topic.ErrWildcardInName)
+type TopicError struct {
+	Topic string
+	Err   error
+}
+
+// Error returns the reason the topic is invalid (along with the topic, truncated if long)
+func (e *TopicError) Error() string {
+	t := e.Topic
+	if len(t) > 64 {
+		t = t[:64] + "..."
+	}
+	return fmt.Sprintf("%s: %q", e.Err, t)
+}
+
+// Unwrap returns the reason the topic is invalid
+func (e *TopicError) Unwrap() error {
+	return e.Err
+}
+
+// commsError wraps an error from the network connection in a NetworkError (unless it indicates a protocol
+// violation or has already been wrapped). write should be true if the error occurred whilst sending, in which
+// case timeouts will also match ErrWriteTimeout.
+func commsError(err error, write bool) error {
+	var ne *NetworkError
+	if err == nil || errors.As(err, &ne) || errors.Is(err, ErrProtocolViolation) {
+		return err
+	}
+	var te net.Error
+	if write && errors.As(err, &te) && te.Timeout() {
+		err = fmt.Errorf("%w: %w", ErrWriteTimeout, err)
+	}
+	return &NetworkError{Err: err}
+}
@@ -0,0 +1,163 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SignJWT creates a compact JWT containing claims signed with key. An *rsa.PrivateKey produces an RS256 token and
+// an *ecdsa.PrivateKey (P-256) an ES256 token.
+func SignJWT(key crypto.Signer, claims map[string]interface{}) (string, error) {
+	var alg string
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return "", errors.New("jwt: ES256 requires a P-256 key")
+		}
+		alg = "ES256"
+	default:
+		return "", fmt.Errorf("jwt: unsupported key type %T", key)
+	}
+
+	hdr, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(hdr) + "." + enc.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		sig = make([]byte, 64) // JWS uses the fixed length R || S encoding rather than ASN.1
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+// ParsePrivateKeyPEM parses a PEM encoded RSA or ECDSA private key (PKCS#1, SEC 1 or PKCS#8) for use with SignJWT
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("jwt: no PEM data found")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: unable to parse private key: %w", err)
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("jwt: unsupported key type %T", k)
+	}
+	return signer, nil
+}
+
+// LoadPrivateKeyPEM reads a PEM encoded private key from a file (see ParsePrivateKeyPEM)
+func LoadPrivateKeyPEM(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKeyPEM(data)
+}
+
+// JWTAuthProvider is an AuthProvider that sends a signed JWT as the password. The token includes iat and exp
+// claims (plus any provided in Claims) and is reused whilst more than half of its lifetime remains.
+type JWTAuthProvider struct {
+	Username string                 // Sent as the username (some brokers require a fixed value, e.g. "unused")
+	Key      crypto.Signer          // *rsa.PrivateKey (RS256) or *ecdsa.PrivateKey (ES256)
+	Lifetime time.Duration          // How long each token is valid for (default 1 hour)
+	Claims   map[string]interface{} // Additional claims (e.g. "aud")
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+	expiry time.Time
+}
+
+// NewJWTAuthProvider creates a JWTAuthProvider; claims may be nil
+func NewJWTAuthProvider(username string, key crypto.Signer, lifetime time.Duration, claims map[string]interface{}) *JWTAuthProvider {
+	return &JWTAuthProvider{
+		Username: username,
+		Key:      key,
+		Lifetime: lifetime,
+		Claims:   claims,
+	}
+}
+
+// Credentials returns the current token, signing a new one if required (or if refresh is true)
+func (p *JWTAuthProvider) Credentials(refresh bool) (Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if !refresh && p.token != "" && now.Before(p.issued.Add(p.expiry.Sub(p.issued)/2)) {
+		return Credentials{Username: p.Username, Password: p.token, Expiry: p.expiry}, nil
+	}
+
+	lifetime := p.Lifetime
+	if lifetime <= 0 {
+		lifetime = time.Hour
+	}
+	issued := now.Truncate(time.Second) // iat/exp are in whole seconds
+	expiry := issued.Add(lifetime)
+	claims := make(map[string]interface{}, len(p.Claims)+2)
+	for k, v := range p.Claims {
+		claims[k] = v
+	}
+	claims["iat"] = issued.Unix()
+	claims["exp"] = expiry.Unix()
+	token, err := SignJWT(p.Key, claims)
+	if err != nil {
+		return Credentials{}, err
+	}
+	p.token, p.issued, p.expiry = token, issued, expiry
+	return Credentials{Username: p.Username, Password: token, Expiry: expiry}, nil
+}
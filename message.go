@@ -21,6 +21,7 @@ package mqtt
 import (
 	"net/url"
 	"sync"
+	"sync/atomic"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
@@ -47,6 +48,8 @@ type message struct {
 	payload   []byte
 	once      sync.Once
 	ack       func()
+	noAck     func() // called (instead of ack) if it is determined that the message will not be acknowledged
+	nacked    atomic.Bool
 }
 
 func (m *message) Duplicate() bool {
@@ -77,7 +80,17 @@ func (m *message) Ack() {
 	m.once.Do(m.ack)
 }
 
-func messageFromPublish(p *packets.PublishPacket, ack func()) Message {
+// abandon indicates that the message will not be acknowledged; subsequent calls to Ack will have no effect
+func (m *message) abandon() {
+	m.once.Do(func() {
+		m.nacked.Store(true)
+		if m.noAck != nil {
+			m.noAck()
+		}
+	})
+}
+
+func messageFromPublish(p *packets.PublishPacket, ack func()) *message {
 	return &message{
 		duplicate: p.Dup,
 		qos:       p.Qos,
@@ -111,7 +124,7 @@ func newConnectMsgFromOptions(options *ClientOptions, broker *url.URL) *packets.
 			password = pwd
 		}
 	}
-	if options.CredentialsProvider != nil {
+	if options.CredentialsProvider != nil && options.AuthProvider == nil { // AuthProvider credentials are applied later
 		username, password = options.CredentialsProvider()
 	}
 
@@ -48,11 +48,11 @@ func (mids *messageIds) cleanUp() {
 	for _, token := range mids.index {
 		switch token.(type) {
 		case *PublishToken:
-			token.setError(fmt.Errorf("connection lost before Publish completed"))
+			token.setError(fmt.Errorf("%w before Publish completed", ErrConnectionLost))
 		case *SubscribeToken:
-			token.setError(fmt.Errorf("connection lost before Subscribe completed"))
+			token.setError(fmt.Errorf("%w before Subscribe completed", ErrConnectionLost))
 		case *UnsubscribeToken:
-			token.setError(fmt.Errorf("connection lost before Unsubscribe completed"))
+			token.setError(fmt.Errorf("%w before Unsubscribe completed", ErrConnectionLost))
 		case nil: // should not be any nil entries
 			continue
 		}
@@ -70,10 +70,10 @@ func (mids *messageIds) cleanUpSubscribe() {
 	for mid, token := range mids.index {
 		switch token.(type) {
 		case *SubscribeToken:
-			token.setError(fmt.Errorf("connection lost before Subscribe completed"))
+			token.setError(fmt.Errorf("%w before Subscribe completed", ErrConnectionLost))
 			delete(mids.index, mid)
 		case *UnsubscribeToken:
-			token.setError(fmt.Errorf("connection lost before Unsubscribe completed"))
+			token.setError(fmt.Errorf("%w before Unsubscribe completed", ErrConnectionLost))
 			delete(mids.index, mid)
 		}
 	}
@@ -126,6 +126,19 @@ func (mids *messageIds) getID(t tokenCompletor) uint16 {
 	}
 }
 
+// publishTokens returns the tokens of publishes that are in progress
+func (mids *messageIds) publishTokens() []*PublishToken {
+	mids.mu.RLock()
+	defer mids.mu.RUnlock()
+	var tokens []*PublishToken
+	for _, t := range mids.index {
+		if pt, ok := t.(*PublishToken); ok {
+			tokens = append(tokens, pt)
+		}
+	}
+	return tokens
+}
+
 func (mids *messageIds) getToken(id uint16) tokenCompletor {
 	mids.mu.RLock()
 	defer mids.mu.RUnlock()
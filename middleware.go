@@ -0,0 +1,74 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+// MessageMiddleware wraps a MessageHandler in order to add functionality that applies to many handlers (e.g.
+// logging, metrics or decompression). The returned handler would usually call next.
+type MessageMiddleware func(next MessageHandler) MessageHandler
+
+// ChainMiddleware wraps handler with the middleware provided; the first middleware will be the outermost (i.e.
+// the first to be called when a message arrives)
+func ChainMiddleware(handler MessageHandler, middleware ...MessageMiddleware) MessageHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// RecoverMiddleware recovers from any panic in the handler; the panic (and stack trace) is logged to ERROR and,
+// if onPanic is not nil, passed to onPanic. Note that the message will be acknowledged as if the handler had
+// completed successfully (unless AutoAckDisabled is set).
+func RecoverMiddleware(onPanic func(m Message, recovered interface{})) MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c Client, m Message) {
+			defer func() {
+				if r := recover(); r != nil {
+					ERROR.Println(ROU, "message handler panic, topic:", m.Topic(), "panic:", r, string(debug.Stack()))
+					if onPanic != nil {
+						onPanic(m, r)
+					}
+				}
+			}()
+			next(c, m)
+		}
+	}
+}
+
+// TimingMiddleware calls observe with the time taken by the handler to process each message
+func TimingMiddleware(observe func(m Message, d time.Duration)) MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c Client, m Message) {
+			start := time.Now()
+			defer func() { observe(m, time.Since(start)) }()
+			next(c, m)
+		}
+	}
+}
+
+// LoggingMiddleware logs the details of each message (topic, QoS, message ID, flags and payload size) to
+// logger before calling the handler
+func LoggingMiddleware(logger Logger) MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c Client, m Message) {
+			logger.Printf("message received topic: %s qos: %d id: %d retained: %t duplicate: %t size: %d",
+				m.Topic(), m.Qos(), m.MessageID(), m.Retained(), m.Duplicate(), len(m.Payload()))
+			next(c, m)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/topic"
+)
+
+// ErrOutsideNamespace is returned (wrapped) when a topic cannot be mapped into the namespace (e.g. a $SYS topic)
+var ErrOutsideNamespace = errors.New("topic outside namespace")
+
+// TopicRewriter maps topics between those used by the application and those used on the broker (see
+// NewNamespacedClient)
+type TopicRewriter interface {
+	// ToBroker converts a topic name or filter used by the application into the one used on the broker; an error
+	// (wrapping ErrOutsideNamespace) is returned if the topic cannot be mapped.
+	ToBroker(topic string) (string, error)
+	// FromBroker converts a topic name received from the broker into the one presented to the application; ok is
+	// false if the topic is not within the namespace.
+	FromBroker(topic string) (name string, ok bool)
+}
+
+// PrefixRewriter places all topics under Prefix (e.g. "tenants/42/"). Topics beginning with $ (e.g. $SYS/#) are
+// rejected as they cannot be placed in the namespace; shared subscriptions are supported (the prefix is applied
+// to the filter, i.e. $share/group/{Prefix}{filter}).
+type PrefixRewriter struct {
+	Prefix string
+}
+
+// NewPrefixRewriter returns a PrefixRewriter for prefix (a trailing / is added if not present)
+func NewPrefixRewriter(prefix string) *PrefixRewriter {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &PrefixRewriter{Prefix: prefix}
+}
+
+// ToBroker prepends the prefix to t
+func (p *PrefixRewriter) ToBroker(t string) (string, error) {
+	if t == "" {
+		return "", topic.ErrEmpty
+	}
+	if group, f, ok := topic.SplitShared(t); ok {
+		if f, err := p.ToBroker(f); err == nil {
+			return "$share/" + group + "/" + f, nil
+		}
+	}
+	if strings.HasPrefix(t, "$") {
+		return "", fmt.Errorf("%w: %s", ErrOutsideNamespace, t)
+	}
+	return p.Prefix + t, nil
+}
+
+// FromBroker removes the prefix from t
+func (p *PrefixRewriter) FromBroker(t string) (string, bool) {
+	if !strings.HasPrefix(t, p.Prefix) {
+		return t, false
+	}
+	return t[len(p.Prefix):], true
+}
+
+// MapRewriter maps topics using a table (exact matches only); topics not in the table are passed to Next (if Next
+// is nil they are rejected).
+type MapRewriter struct {
+	Next    TopicRewriter
+	table   map[string]string // application -> broker
+	reverse map[string]string // broker -> application
+}
+
+// NewMapRewriter creates a MapRewriter; table maps application topics to broker topics (and must not map two
+// topics to the same broker topic). next may be nil.
+func NewMapRewriter(table map[string]string, next TopicRewriter) *MapRewriter {
+	m := &MapRewriter{Next: next, table: make(map[string]string, len(table)), reverse: make(map[string]string, len(table))}
+	for app, broker := range table {
+		m.table[app] = broker
+		m.reverse[broker] = app
+	}
+	return m
+}
+
+// ToBroker returns the mapping for t (or the result from Next)
+func (m *MapRewriter) ToBroker(t string) (string, error) {
+	if b, ok := m.table[t]; ok {
+		return b, nil
+	}
+	if m.Next == nil {
+		return "", fmt.Errorf("%w: no mapping for %s", ErrOutsideNamespace, t)
+	}
+	return m.Next.ToBroker(t)
+}
+
+// FromBroker returns the reverse mapping for t (or the result from Next)
+func (m *MapRewriter) FromBroker(t string) (string, bool) {
+	if a, ok := m.reverse[t]; ok {
+		return a, true
+	}
+	if m.Next == nil {
+		return t, false
+	}
+	return m.Next.FromBroker(t)
+}
+
+// namespacedClient implements Client, rewriting topics with a TopicRewriter
+type namespacedClient struct {
+	c       *client
+	rw      TopicRewriter
+	outside atomic.Uint64 // messages dropped because their topic was outside the namespace
+}
+
+var _ extendedClient = (*namespacedClient)(nil)
+
+// NewNamespacedClient creates a client (as per NewClient) that transparently rewrites topics using rw. Topics
+// passed to Publish, Subscribe, Unsubscribe, AddRoute etc. are converted with rw.ToBroker (operations on topics
+// that cannot be converted fail with an error wrapping ErrOutsideNamespace) and the topics of messages passed to
+// handlers are converted with rw.FromBroker. Messages outside the namespace (e.g. due to an overlapping
+// subscription made by another client using the same session) are acknowledged and dropped without being passed
+// to a handler; they are logged to WARN and counted in ClientStats.OutsideNamespace. The will topic and default
+// publish handler in o are also rewritten.
+//
+// Note that the client passed to handlers (including those in o, e.g. OnConnect) will be the namespaced client,
+// but messages passed to the handlers in o (other than the default publish handler) retain the broker topic, as
+// do the results of SubscribeToken.Result,
+// Subscription.Topic and OptionsReader use the broker topics. Middleware added with Use receives messages before
+// their topic is rewritten.
+func NewNamespacedClient(o *ClientOptions, rw TopicRewriter) (Client, error) {
+	n := &namespacedClient{rw: rw}
+	opts := *o
+	if opts.WillEnabled {
+		will, err := rw.ToBroker(opts.WillTopic)
+		if err != nil {
+			return nil, fmt.Errorf("will topic: %w", err)
+		}
+		opts.WillTopic = will
+	}
+	if opts.DefaultPublishHandler != nil {
+		opts.DefaultPublishHandler = n.wrap(opts.DefaultPublishHandler)
+	}
+	if h := opts.OnConnect; h != nil {
+		opts.OnConnect = func(Client) { h(n) }
+	}
+	if h := opts.OnConnectionLost; h != nil {
+		opts.OnConnectionLost = func(_ Client, err error) { h(n, err) }
+	}
+	if h := opts.OnReconnecting; h != nil {
+		opts.OnReconnecting = func(_ Client, o *ClientOptions) { h(n, o) }
+	}
+	if h := opts.OnHandlerPanic; h != nil {
+		opts.OnHandlerPanic = func(_ Client, m Message, recovered interface{}, stack []byte) { h(n, m, recovered, stack) }
+	}
+	if h := opts.OnAckTimeout; h != nil {
+		opts.OnAckTimeout = func(_ Client, m Message) { h(n, m) }
+	}
+	if h := opts.OnDeadLetter; h != nil {
+		opts.OnDeadLetter = func(_ Client, dl *DeadLetter) { h(n, dl) }
+	}
+	if h := opts.OnHandlerError; h != nil {
+		opts.OnHandlerError = func(_ Client, m Message, err error, attempt int) { h(n, m, err, attempt) }
+	}
+	n.c = NewClient(&opts).(*client)
+	return n, nil
+}
+
+// namespacedMessage presents a message with the topic converted by TopicRewriter.FromBroker
+type namespacedMessage struct {
+	Message
+	topic string
+}
+
+func (m *namespacedMessage) Topic() string {
+	return m.topic
+}
+
+// namespacedParamMessage is a namespacedMessage that retains access to the route parameters
+type namespacedParamMessage struct {
+	namespacedMessage
+	params ParamMessage
+}
+
+func (m *namespacedParamMessage) Param(name string) string {
+	return m.params.Param(name)
+}
+
+func (m *namespacedParamMessage) Params() map[string]string {
+	return m.params.Params()
+}
+
+// wrap returns a handler that rewrites the message topic (and passes n as the client) before calling handler;
+// messages outside the namespace are acknowledged and dropped.
+func (n *namespacedClient) wrap(handler MessageHandler) MessageHandler {
+	if handler == nil {
+		return nil
+	}
+	return func(_ Client, m Message) {
+		name, ok := n.rw.FromBroker(m.Topic())
+		if !ok {
+			n.outside.Add(1)
+			WARN.Println(CLI, "dropping message received outside namespace, topic:", m.Topic())
+			m.Ack()
+			return
+		}
+		nm := namespacedMessage{Message: m, topic: name}
+		if pm, ok := m.(ParamMessage); ok {
+			handler(n, &namespacedParamMessage{namespacedMessage: nm, params: pm})
+			return
+		}
+		handler(n, &nm)
+	}
+}
+
+// failedToken returns a completed token of the type specified containing err
+func failedToken(tType byte, err error) Token {
+	t := newToken(tType)
+	t.setError(err)
+	return t
+}
+
+// releasedHandle returns a Subscription that has already been released (returned, as per SubscribeWithHandle, when
+// the subscription fails)
+func (n *namespacedClient) releasedHandle(topic string) *Subscription {
+	s := &Subscription{client: n.c, topic: topic}
+	s.released.Store(true)
+	return s
+}
+
+func (n *namespacedClient) IsConnected() bool {
+	return n.c.IsConnected()
+}
+
+func (n *namespacedClient) IsConnectionOpen() bool {
+	return n.c.IsConnectionOpen()
+}
+
+func (n *namespacedClient) Connect() Token {
+	return n.c.Connect()
+}
+
+func (n *namespacedClient) Disconnect(quiesce uint) {
+	n.c.Disconnect(quiesce)
+}
+
+func (n *namespacedClient) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
+	t, err := n.rw.ToBroker(topic)
+	if err != nil {
+		return failedToken(packets.Publish, err)
+	}
+	return n.c.Publish(t, qos, retained, payload)
+}
+
+func (n *namespacedClient) PublishAsync(topic string, qos byte, retained bool, payload interface{}, callback PublishCallback) {
+	token := n.c.asyncToken(topic, callback) // the result reports the topic without the namespace
+	t, err := n.rw.ToBroker(topic)
+	if err != nil {
+		token.setError(err)
+		return
+	}
+	n.c.publish(t, qos, retained, payload, token)
+}
+
+func (n *namespacedClient) Subscribe(topic string, qos byte, callback MessageHandler) Token {
+	t, err := n.rw.ToBroker(topic)
+	if err != nil {
+		return failedToken(packets.Subscribe, err)
+	}
+	return n.c.Subscribe(t, qos, n.wrap(callback))
+}
+
+func (n *namespacedClient) SubscribeMultiple(filters map[string]byte, callback MessageHandler) Token {
+	rewritten := make(map[string]byte, len(filters))
+	for topic, qos := range filters {
+		t, err := n.rw.ToBroker(topic)
+		if err != nil {
+			return failedToken(packets.Subscribe, err)
+		}
+		rewritten[t] = qos
+	}
+	return n.c.SubscribeMultiple(rewritten, n.wrap(callback))
+}
+
+func (n *namespacedClient) Unsubscribe(topics ...string) Token {
+	rewritten := make([]string, len(topics))
+	for i, topic := range topics {
+		t, err := n.rw.ToBroker(topic)
+		if err != nil {
+			return failedToken(packets.Unsubscribe, err)
+		}
+		rewritten[i] = t
+	}
+	return n.c.Unsubscribe(rewritten...)
+}
+
+func (n *namespacedClient) AddRoute(topic string, callback MessageHandler) {
+	n.AddRouteWithMiddleware(topic, callback)
+}
+
+func (n *namespacedClient) AddRouteWithMiddleware(topic string, callback MessageHandler, middleware ...MessageMiddleware) {
+	t, err := n.rw.ToBroker(topic)
+	if err != nil {
+		ERROR.Println(CLI, "route not added:", err)
+		return
+	}
+	n.c.AddRouteWithMiddleware(t, n.wrap(callback), middleware...)
+}
+
+func (n *namespacedClient) Use(middleware ...MessageMiddleware) {
+	n.c.Use(middleware...)
+}
+
+func (n *namespacedClient) SubscribeChan(topic string, qos byte, bufferSize int, overflow OverflowPolicy) (*ChanSubscription, Token) {
+	t, err := n.rw.ToBroker(topic)
+	if err != nil {
+		s := &ChanSubscription{client: n.c, sub: n.releasedHandle(topic), ch: make(chan Message), done: make(chan struct{})}
+		s.close()
+		return s, failedToken(packets.Subscribe, err)
+	}
+	return n.c.subscribeChan(t, qos, bufferSize, overflow, n.wrap)
+}
+
+func (n *namespacedClient) SubscribeWithHandle(topic string, qos byte, callback MessageHandler) (*Subscription, Token) {
+	t, err := n.rw.ToBroker(topic)
+	if err != nil {
+		return n.releasedHandle(topic), failedToken(packets.Subscribe, err)
+	}
+	return n.c.SubscribeWithHandle(t, qos, n.wrap(callback))
+}
+
+func (n *namespacedClient) Stats() ClientStats {
+	s := n.c.Stats()
+	s.OutsideNamespace = n.outside.Load()
+	return s
+}
+
+func (n *namespacedClient) Shutdown(ctx context.Context) error {
+	return n.c.Shutdown(ctx)
+}
+
+func (n *namespacedClient) Close() error {
+	return n.c.Close()
+}
+
+func (n *namespacedClient) OptionsReader() ClientOptionsReader {
+	return n.c.OptionsReader()
+}
@@ -21,6 +21,7 @@ package mqtt
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"reflect"
@@ -94,7 +95,7 @@ func verifyCONNACK(conn io.Reader) (byte, bool, error) {
 	msg, ok := ca.(*packets.ConnackPacket)
 	if !ok {
 		ERROR.Println(NET, "received msg that was not CONNACK")
-		return packets.ErrNetworkError, false, errors.New("non-CONNACK first packet received")
+		return packets.ErrNetworkError, false, fmt.Errorf("%w: non-CONNACK first packet received", ErrProtocolViolation)
 	}
 
 	DEBUG.Println(NET, "received connack")
@@ -126,7 +127,7 @@ func startIncoming(conn io.Reader) <-chan inbound {
 				// elsewhere (i.e. after sending DisconnectPacket). Detecting this situation is the subject of
 				// https://github.com/golang/go/issues/4373
 				if !strings.Contains(err.Error(), closedNetConnErrorText) {
-					ibound <- inbound{err: err}
+					ibound <- inbound{err: commsError(err, false)}
 				}
 				close(ibound)
 				DEBUG.Println(NET, "incoming complete")
@@ -221,6 +222,13 @@ func startIncomingComms(conn io.Reader,
 				c.freeID(m.MessageID)
 			case *packets.PublishPacket:
 				DEBUG.Println(NET, "startIncomingComms: received publish, msgId:", m.MessageID)
+				if c.holdInbound(m) { // delivered when PUBREL is received
+					pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+					pr.MessageID = m.MessageID
+					output <- incomingComms{outbound: &PacketAndToken{p: pr, t: nil}}
+					continue
+				}
+				c.publishReceived()
 				output <- incomingComms{incomingPub: m}
 			case *packets.PubackPacket:
 				DEBUG.Println(NET, "startIncomingComms: received puback, id:", m.MessageID)
@@ -233,6 +241,13 @@ func startIncomingComms(conn io.Reader,
 				output <- incomingComms{outbound: &PacketAndToken{p: prel, t: nil}}
 			case *packets.PubrelPacket:
 				DEBUG.Println(NET, "startIncomingComms: received pubrel, id:", m.MessageID)
+				if pub, held := c.releaseInbound(m.MessageID); held { // PUBCOMP will be sent when the message is acknowledged
+					if pub != nil {
+						c.publishReceived()
+						output <- incomingComms{incomingPub: pub}
+					}
+					continue
+				}
 				pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
 				pc.MessageID = m.MessageID
 				c.persistOutbound(pc)
@@ -291,6 +306,7 @@ func startOutgoingComms(conn net.Conn,
 				}
 
 				if err := msg.Write(conn); err != nil {
+					err = commsError(err, true)
 					ERROR.Println(NET, "outgoing obound reporting error ", err)
 					pub.t.setError(err)
 					// report error if it's not due to the connection being closed elsewhere
@@ -319,6 +335,7 @@ func startOutgoingComms(conn net.Conn,
 				}
 				DEBUG.Println(NET, "obound priority msg to write, type", reflect.TypeOf(msg.p))
 				if err := msg.p.Write(conn); err != nil {
+					err = commsError(err, true)
 					ERROR.Println(NET, "outgoing oboundp reporting error ", err)
 					if msg.t != nil {
 						msg.t.setError(err)
@@ -341,6 +358,7 @@ func startOutgoingComms(conn net.Conn,
 				}
 				DEBUG.Println(NET, "obound from incoming msg to write, type", reflect.TypeOf(msg.p), " ID ", msg.p.Details().MessageID)
 				if err := msg.p.Write(conn); err != nil {
+					err = commsError(err, true)
 					ERROR.Println(NET, "outgoing oboundFromIncoming reporting error", err)
 					if msg.t != nil {
 						msg.t.setError(err)
@@ -365,6 +383,10 @@ type commsFns interface {
 	persistOutbound(m packets.ControlPacket) // add the packet to the outbound store
 	persistInbound(m packets.ControlPacket)  // add the packet to the inbound store
 	pingRespReceived()                       // Called when a ping response is received
+
+	holdInbound(p *packets.PublishPacket) bool                      // true if the QoS 2 PUBLISH is to be held until PUBREL
+	releaseInbound(id uint16) (p *packets.PublishPacket, held bool) // returns the held PUBLISH (if any) when PUBREL received
+	publishReceived()                                               // Called when a PUBLISH is passed on to be dispatched
 }
 
 // startComms initiates goroutines that handles communications over the network connection
@@ -443,25 +465,23 @@ func startComms(conn net.Conn, // Network connection (must be active)
 	return outPublish, outError
 }
 
-// ackFunc acknowledges a packet
-// WARNING the function returned must not be called if the comms routine is shutting down or not running
-// (it needs outgoing comms in order to send the acknowledgement). Currently this is only called from
-// matchAndDispatch which will be shutdown before the comms are
-func ackFunc(oboundP chan *PacketAndToken, persist Store, packet *packets.PublishPacket) func() {
+// ackFunc acknowledges a packet; send passes the acknowledgement to the outgoing comms (it is provided by
+// matchAndDispatch and drops the acknowledgement if the connection the packet was received on has gone)
+func ackFunc(send func(*PacketAndToken), persist Store, packet *packets.PublishPacket) func() {
 	return func() {
 		switch packet.Qos {
 		case 2:
 			pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
 			pr.MessageID = packet.MessageID
 			DEBUG.Println(NET, "putting pubrec msg on obound")
-			oboundP <- &PacketAndToken{p: pr, t: nil}
+			send(&PacketAndToken{p: pr, t: nil})
 			DEBUG.Println(NET, "done putting pubrec msg on obound")
 		case 1:
 			pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
 			pa.MessageID = packet.MessageID
 			DEBUG.Println(NET, "putting puback msg on obound")
 			persistOutbound(persist, pa)
-			oboundP <- &PacketAndToken{p: pa, t: nil}
+			send(&PacketAndToken{p: pa, t: nil})
 			DEBUG.Println(NET, "done putting puback msg on obound")
 		case 0:
 			// do nothing, since there is no need to send an ack packet back
@@ -21,7 +21,7 @@ package mqtt
 
 import (
 	"crypto/tls"
-	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
@@ -37,34 +37,28 @@ import (
 
 // openConnection opens a network connection using the protocol indicated in the URL.
 // Does not carry out any MQTT specific handshakes.
-func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, headers http.Header, websocketOptions *WebsocketOptions, dialer *net.Dialer) (net.Conn, error) {
+// If proxyFn is nil then the all_proxy environment variable is checked for tcp/tls connections (for backwards
+// compatibility); otherwise proxyFn determines the proxy (if any) to use for all schemes other than unix.
+func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, headers http.Header, websocketOptions *WebsocketOptions, dialer *net.Dialer, proxyFn ProxyFunction) (net.Conn, error) {
 	switch uri.Scheme {
-	case "ws":
+	case "ws", "wss":
 		dialURI := *uri // #623 - Gorilla Websockets does not accept URL's where uri.User != nil
 		dialURI.User = nil
-		conn, err := NewWebsocket(dialURI.String(), nil, timeout, headers, websocketOptions)
-		return conn, err
-	case "wss":
-		dialURI := *uri // #623 - Gorilla Websockets does not accept URL's where uri.User != nil
-		dialURI.User = nil
-		conn, err := NewWebsocket(dialURI.String(), tlsc, timeout, headers, websocketOptions)
-		return conn, err
-	case "mqtt", "tcp":
-		allProxy := os.Getenv("all_proxy")
-		if len(allProxy) == 0 {
-			conn, err := dialer.Dial("tcp", uri.Host)
-			if err != nil {
-				return nil, err
+		if proxyFn != nil && (websocketOptions == nil || websocketOptions.Proxy == nil) {
+			wso := WebsocketOptions{}
+			if websocketOptions != nil {
+				wso = *websocketOptions
 			}
-			return conn, nil
+			wso.Proxy = proxyFn
+			websocketOptions = &wso
 		}
-		proxyDialer := proxy.FromEnvironment()
-
-		conn, err := proxyDialer.Dial("tcp", uri.Host)
-		if err != nil {
-			return nil, err
+		if uri.Scheme == "ws" {
+			tlsc = nil
 		}
-		return conn, nil
+		conn, err := newWebsocket(dialURI.String(), tlsc, timeout, headers, websocketOptions, dialer)
+		return conn, err
+	case "mqtt", "tcp":
+		return dialTCP(uri, headers, dialer, proxyFn)
 	case "unix":
 		var conn net.Conn
 		var err error
@@ -82,20 +76,26 @@ func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, heade
 		}
 		return conn, nil
 	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
-		allProxy := os.Getenv("all_proxy")
-		if len(allProxy) == 0 {
+		if proxyFn == nil && len(os.Getenv("all_proxy")) == 0 {
 			conn, err := tls.DialWithDialer(dialer, "tcp", uri.Host, tlsc)
 			if err != nil {
 				return nil, err
 			}
 			return conn, nil
 		}
-		proxyDialer := proxy.FromEnvironment()
-		conn, err := proxyDialer.Dial("tcp", uri.Host)
+		conn, err := dialTCP(uri, headers, dialer, proxyFn)
 		if err != nil {
 			return nil, err
 		}
 
+		// tls.DialWithDialer fills in ServerName if needed; when using a proxy we need to do this ourselves
+		if tlsc == nil {
+			tlsc = &tls.Config{}
+		}
+		if tlsc.ServerName == "" && !tlsc.InsecureSkipVerify {
+			tlsc = tlsc.Clone()
+			tlsc.ServerName = uri.Hostname()
+		}
 		tlsConn := tls.Client(conn, tlsc)
 
 		err = tlsConn.Handshake()
@@ -106,5 +106,24 @@ func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration, heade
 
 		return tlsConn, nil
 	}
-	return nil, errors.New("unknown protocol")
+	return nil, fmt.Errorf("%w: %s", ErrUnknownProtocol, uri.Scheme)
+}
+
+// dialTCP establishes a TCP connection to the broker (via a proxy if one is configured)
+func dialTCP(uri *url.URL, headers http.Header, dialer *net.Dialer, proxyFn ProxyFunction) (net.Conn, error) {
+	if proxyFn == nil {
+		if len(os.Getenv("all_proxy")) == 0 {
+			return dialer.Dial("tcp", uri.Host)
+		}
+		return proxy.FromEnvironment().Dial("tcp", uri.Host)
+	}
+	proxyURL, err := proxyForBroker(proxyFn, uri, headers)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return dialer.Dial("tcp", uri.Host)
+	}
+	DEBUG.Println(NET, "connecting to", uri.Host, "via proxy", proxyURL.Redacted())
+	return dialViaProxy(proxyURL, uri.Host, dialer)
 }
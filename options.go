@@ -36,7 +36,8 @@ type CredentialsProvider func() (username string, password string)
 
 // MessageHandler is a callback type which can be set to be
 // executed upon the arrival of messages published to topics
-// to which the client is subscribed.
+// to which the client is subscribed. Use HandleErrors to create
+// a MessageHandler from a handler that returns an error.
 type MessageHandler func(Client, Message)
 
 // ConnectionLostHandler is a callback type which can be set to be
@@ -54,6 +55,23 @@ type OnConnectHandler func(Client)
 // the initial connection is lost
 type ReconnectHandler func(Client, *ClientOptions)
 
+// HandlerPanicHandler is invoked when a MessageHandler panics; recovered is the value passed to panic and
+// stack the stack trace of the handler goroutine.
+type HandlerPanicHandler func(client Client, msg Message, recovered interface{}, stack []byte)
+
+// HandlerPanicPolicy determines what happens to a message whose handler panicked
+type HandlerPanicPolicy byte
+
+const (
+	// HandlerPanicAck acknowledges the message (as if the handler had returned normally); the default
+	HandlerPanicAck HandlerPanicPolicy = iota
+	// HandlerPanicNoAck does not acknowledge the message (it may be redelivered by the broker when the session is resumed)
+	HandlerPanicNoAck
+	// HandlerPanicDisconnect does not acknowledge the message and drops the connection (ConnectionLostHandler will
+	// be called with an error wrapping ErrHandlerPanic; the client will reconnect if AutoReconnect is set)
+	HandlerPanicDisconnect
+)
+
 // ConnectionAttemptHandler is invoked prior to making the initial connection.
 type ConnectionAttemptHandler func(broker *url.URL, tlsCfg *tls.Config) *tls.Config
 
@@ -73,6 +91,8 @@ type ClientOptions struct {
 	Username                string
 	Password                string
 	CredentialsProvider     CredentialsProvider
+	AuthProvider            AuthProvider
+	AuthRefreshBefore       time.Duration
 	CleanSession            bool
 	Order                   bool
 	WillEnabled             bool
@@ -83,6 +103,7 @@ type ClientOptions struct {
 	ProtocolVersion         uint
 	protocolVersionExplicit bool
 	TLSConfig               *tls.Config
+	TLSReloader             *TLSReloader
 	KeepAlive               int64 // Warning: Some brokers may reject connections with Keepalive = 0.
 	PingTimeout             time.Duration
 	ConnectTimeout          time.Duration
@@ -103,8 +124,35 @@ type ClientOptions struct {
 	WebsocketOptions        *WebsocketOptions
 	MaxResumePubInFlight    int // // 0 = no limit; otherwise this is the maximum simultaneous messages sent while resuming
 	Dialer                  *net.Dialer
+	Proxy                   ProxyFunction
 	CustomOpenConnectionFn  OpenConnectionFunc
 	AutoAckDisabled         bool
+	OnHandlerPanic          HandlerPanicHandler
+	HandlerPanicPolicy      HandlerPanicPolicy
+	DispatchWorkers         int
+	DispatchQueueDepth      int
+	KeyedDispatchWorkers    int
+	KeyedDispatchKey        DispatchKeyFunc
+	TopicPolicy             *TopicPolicy
+	EchoSuppressionWindow   time.Duration
+	LocalDelivery           bool
+	AckTimeout              time.Duration
+	OnAckTimeout            AckTimeoutHandler
+	OrderedAcks             bool
+	OnDeadLetter            DeadLetterHandler
+	DeadLetterTopic         string
+	DeadLetterQos           byte
+	DeadLetterStore         Store
+	DeadLetterAck           bool
+	HandlerRetries          int
+	HandlerRetryInterval    time.Duration
+	HandlerRetryMaxInterval time.Duration
+	HandlerErrorPolicy      HandlerErrorPolicy
+	OnHandlerError          HandlerErrorHandler
+	DedupStore              DedupStore
+	DedupWindow             time.Duration
+	Qos2DeliverOnPubrel     bool
+	RouteParams             bool
 }
 
 // NewClientOptions will create a new ClientClientOptions type with some
@@ -122,6 +170,7 @@ func NewClientOptions() *ClientOptions {
 		ClientID:                "",
 		Username:                "",
 		Password:                "",
+		AuthRefreshBefore:       time.Minute,
 		CleanSession:            true,
 		Order:                   true,
 		WillEnabled:             false,
@@ -147,8 +196,35 @@ func NewClientOptions() *ClientOptions {
 		HTTPHeaders:             make(map[string][]string),
 		WebsocketOptions:        &WebsocketOptions{},
 		Dialer:                  &net.Dialer{Timeout: 30 * time.Second},
+		Proxy:                   nil,
 		CustomOpenConnectionFn:  nil,
 		AutoAckDisabled:         false,
+		OnHandlerPanic:          nil,
+		HandlerPanicPolicy:      HandlerPanicAck,
+		DispatchWorkers:         0,
+		DispatchQueueDepth:      0,
+		KeyedDispatchWorkers:    0,
+		KeyedDispatchKey:        nil,
+		TopicPolicy:             nil,
+		EchoSuppressionWindow:   0,
+		LocalDelivery:           false,
+		AckTimeout:              0,
+		OnAckTimeout:            nil,
+		OrderedAcks:             false,
+		OnDeadLetter:            nil,
+		DeadLetterTopic:         "",
+		DeadLetterQos:           0,
+		DeadLetterStore:         nil,
+		DeadLetterAck:           false,
+		HandlerRetries:          0,
+		HandlerRetryInterval:    100 * time.Millisecond,
+		HandlerRetryMaxInterval: 10 * time.Second,
+		HandlerErrorPolicy:      HandlerErrorNoAck,
+		OnHandlerError:          nil,
+		DedupStore:              nil,
+		DedupWindow:             time.Hour,
+		Qos2DeliverOnPubrel:     false,
+		RouteParams:             false,
 	}
 	return o
 }
@@ -217,6 +293,26 @@ func (o *ClientOptions) SetCredentialsProvider(p CredentialsProvider) *ClientOpt
 	return o
 }
 
+// SetAuthProvider will set an AuthProvider that supplies the credentials (which may have an expiry time)
+// used each time a connection is established; it takes precedence over the CredentialsProvider/Username/Password.
+// If credentials have an expiry then the connection will be re-established (after sending DISCONNECT) before
+// they expire (see SetAuthRefreshBefore; requires AutoReconnect). If the broker rejects the credentials (bad
+// username or password/not authorised) then one further attempt is made with refreshed credentials.
+// Note: without the use of SSL/TLS, this information will be sent in plaintext across the wire.
+func (o *ClientOptions) SetAuthProvider(p AuthProvider) *ClientOptions {
+	o.AuthProvider = p
+	return o
+}
+
+// SetAuthRefreshBefore sets how long before the credentials from the AuthProvider expire the client will
+// reconnect in order to obtain fresh credentials (default 1 minute). If less than twice this remains when the
+// connection is established the client reconnects after half of the remaining lifetime instead (and, to avoid
+// reconnecting repeatedly, a connection is always kept for at least 5 seconds).
+func (o *ClientOptions) SetAuthRefreshBefore(d time.Duration) *ClientOptions {
+	o.AuthRefreshBefore = d
+	return o
+}
+
 // SetCleanSession will set the "clean session" flag in the connect message
 // when this client connects to an MQTT broker. By setting this flag, you are
 // indicating that no messages saved by the broker for this client should be
@@ -249,6 +345,15 @@ func (o *ClientOptions) SetTLSConfig(t *tls.Config) *ClientOptions {
 	return o
 }
 
+// SetTLSReloader sets a TLSReloader that will provide the certificates (and, optionally, RootCAs) used when
+// connecting. These are combined with the TLSConfig (if any) before each connection attempt (and prior to
+// calling the ConnectionAttemptHandler). Whilst connected the reloader is checked periodically and, if so
+// configured, the connection will be re-established when the certificate changes or nears expiry.
+func (o *ClientOptions) SetTLSReloader(r *TLSReloader) *ClientOptions {
+	o.TLSReloader = r
+	return o
+}
+
 // SetStore will set the implementation of the Store interface
 // used to provide message persistence in cases where QoS levels
 // QoS_ONE or QoS_TWO are used. If no store is provided, then the
@@ -439,6 +544,17 @@ func (o *ClientOptions) SetDialer(dialer *net.Dialer) *ClientOptions {
 	return o
 }
 
+// SetProxy sets the function used to determine the proxy (if any) to use when connecting to a broker. The
+// function is passed a request whose URL is the broker URL and should return the proxy URL (or nil to connect
+// directly); see ProxyFromEnvironment and ProxyURL. HTTP CONNECT (http/https schemes, with basic authentication
+// if credentials are included in the URL) and SOCKS5 proxies are supported for all schemes other than unix.
+// If WebsocketOptions.Proxy is set then it takes precedence for WebSocket connections.
+// If no proxy function is set then the all_proxy environment variable is used (SOCKS5 only) for TCP/TLS connections.
+func (o *ClientOptions) SetProxy(p ProxyFunction) *ClientOptions {
+	o.Proxy = p
+	return o
+}
+
 // SetCustomOpenConnectionFn replaces the inbuilt function that establishes a network connection with a custom function.
 // The passed in function should return an open `net.Conn` or an error (see the existing openConnection function for an example)
 // It enables custom networking types in addition to the defaults (tcp, tls, websockets...)
@@ -451,7 +567,193 @@ func (o *ClientOptions) SetCustomOpenConnectionFn(customOpenConnectionFn OpenCon
 
 // SetAutoAckDisabled enables or disables the Automated Acking of Messages received by the handler.
 //	By default it is set to false. Setting it to true will disable the auto-ack globally.
+//	When disabled, each acknowledgement is sent when Message.Ack is called (see SetOrderedAcks to have them
+//	released in the order the messages were received).
 func (o *ClientOptions) SetAutoAckDisabled(autoAckDisabled bool) *ClientOptions {
 	o.AutoAckDisabled = autoAckDisabled
 	return o
 }
+
+// SetDispatchWorkers sets the number of goroutines used to run message handlers when OrderMatters is false.
+// By default (0) a new goroutine is started for each handler for every message received (there is no limit
+// on the number of goroutines that may be running).
+func (o *ClientOptions) SetDispatchWorkers(workers int) *ClientOptions {
+	o.DispatchWorkers = workers
+	return o
+}
+
+// SetDispatchQueueDepth sets the number of handler calls that may be queued waiting for a dispatch worker (see
+// SetDispatchWorkers; default 0). When the queue is full no further messages will be read from the network until
+// a worker becomes available (providing back-pressure to the broker).
+func (o *ClientOptions) SetDispatchQueueDepth(depth int) *ClientOptions {
+	o.DispatchQueueDepth = depth
+	return o
+}
+
+// SetKeyedDispatch enables keyed dispatch; messages are allocated to one of workers goroutines based on the key
+// returned by key (nil = TopicDispatchKey) so messages with the same key are processed in the order received
+// whilst messages with different keys may be processed concurrently. Acknowledgements are still sent in the order
+// the messages were received (so, if AutoAckDisabled is set, a message that is never acknowledged will prevent
+// later messages from being acknowledged). When workers > 0 this takes precedence over OrderMatters and
+// DispatchWorkers; DispatchQueueDepth applies to each worker. Note that reading from the network is paused when
+// the queue for a worker is full so a non-zero DispatchQueueDepth is recommended.
+func (o *ClientOptions) SetKeyedDispatch(workers int, key DispatchKeyFunc) *ClientOptions {
+	o.KeyedDispatchWorkers = workers
+	o.KeyedDispatchKey = key
+	return o
+}
+
+// SetTopicPolicy sets a policy restricting the topics that can be published and subscribed to (see TopicPolicy).
+// Operations denied by the policy fail (with a *PolicyError) before anything is sent to the broker.
+func (o *ClientOptions) SetTopicPolicy(p *TopicPolicy) *ClientOptions {
+	o.TopicPolicy = p
+	return o
+}
+
+// SetEchoSuppression enables suppression of the client's own messages when the broker sends them back (MQTT v3.1.1
+// has no way to ask the broker not to do this). Each message published is tracked (by a digest of its topic and
+// payload; the message itself is not altered) for the period specified and the first matching message received in
+// that time is acknowledged but not passed to any handler. Note that this means an identical message published by
+// another client within the window will also be suppressed (if one of our own has not been received). A window
+// of 0 (the default) disables suppression.
+func (o *ClientOptions) SetEchoSuppression(window time.Duration) *ClientOptions {
+	o.EchoSuppressionWindow = window
+	return o
+}
+
+// SetLocalDelivery, if true, causes messages published by the client to be passed to its own matching routes (or
+// the default handler) without a round trip to the broker, regardless of whether the client is connected.
+// Echo suppression is enabled (with a 30 second window unless set with SetEchoSuppression) so that handlers do
+// not receive the message twice. Locally delivered messages are passed to handlers, in the order published, on a
+// goroutine managed by the client (so a handler may call Publish, but the message may not have been handled when
+// Publish returns); Message.Ack has no effect on them.
+func (o *ClientOptions) SetLocalDelivery(local bool) *ClientOptions {
+	o.LocalDelivery = local
+	return o
+}
+
+// SetAckTimeout sets the period within which messages must be acknowledged when AutoAckDisabled is set. A message
+// that is not acknowledged in time is treated as if Nack had been called (so it will not hold up acknowledgement of
+// later messages if OrderedAcks is set), logged to WARN and passed to the AckTimeoutHandler (if set). 0 (the
+// default) means no timeout.
+func (o *ClientOptions) SetAckTimeout(timeout time.Duration) *ClientOptions {
+	o.AckTimeout = timeout
+	return o
+}
+
+// SetOrderedAcks, if true, causes acknowledgements to be released in the order the messages were received (as
+// required by the spec) when AutoAckDisabled is set, regardless of the order in which Message.Ack is called. Note
+// that a message that is never acknowledged (or passed to Nack) will then hold up all later acknowledgements, so
+// setting an AckTimeout is recommended. Off by default (each acknowledgement is sent when Ack is called).
+func (o *ClientOptions) SetOrderedAcks(ordered bool) *ClientOptions {
+	o.OrderedAcks = ordered
+	return o
+}
+
+// SetAckTimeoutHandler sets the function that will be called when a message is not acknowledged within the
+// AckTimeout. This is called from its own goroutine.
+func (o *ClientOptions) SetAckTimeoutHandler(h AckTimeoutHandler) *ClientOptions {
+	o.OnAckTimeout = h
+	return o
+}
+
+// SetDeadLetterHandler sets the function that will be called when a message is dead-lettered; that is, when
+// there is no route (or default handler) for a message received, a handler panics or a MessageHandlerE fails (with
+// HandlerErrorDeadLetter). This is called from the goroutine processing messages so should not block.
+func (o *ClientOptions) SetDeadLetterHandler(h DeadLetterHandler) *ClientOptions {
+	o.OnDeadLetter = h
+	return o
+}
+
+// SetDeadLetterTopic causes dead-lettered messages to be republished (JSON encoded, see DeadLetter) to topic with
+// the specified QoS. Messages received on the dead-letter topic itself are never republished.
+func (o *ClientOptions) SetDeadLetterTopic(topic string, qos byte) *ClientOptions {
+	o.DeadLetterTopic = topic
+	o.DeadLetterQos = qos
+	return o
+}
+
+// SetDeadLetterStore causes dead-lettered messages to be written to s (use LoadDeadLetters to retrieve them). s
+// is opened by Connect and closed by the final disconnect (as is the Store set with SetStore, which s must not be),
+// so it must be opened by the caller to load the dead letters when the client is not connected.
+func (o *ClientOptions) SetDeadLetterStore(s Store) *ClientOptions {
+	o.DeadLetterStore = s
+	return o
+}
+
+// SetDeadLetterAck determines whether QoS 1 & 2 messages for which there is no route (or default handler) are
+// acknowledged (after being dead-lettered). By default they are not acknowledged (so the broker may redeliver
+// them when the session is resumed); whether messages whose handler panicked are acknowledged is determined by
+// the HandlerPanicPolicy.
+func (o *ClientOptions) SetDeadLetterAck(ack bool) *ClientOptions {
+	o.DeadLetterAck = ack
+	return o
+}
+
+// SetHandlerRetry sets the number of times a MessageHandlerE (see HandleErrors) that returns an error will be
+// retried. The first retry is made after interval, which is doubled for each subsequent retry (up to maxInterval).
+// The default is 0 (no retries).
+func (o *ClientOptions) SetHandlerRetry(retries int, interval, maxInterval time.Duration) *ClientOptions {
+	o.HandlerRetries = retries
+	o.HandlerRetryInterval = interval
+	o.HandlerRetryMaxInterval = maxInterval
+	return o
+}
+
+// SetHandlerErrorPolicy sets what happens to a message when a MessageHandlerE returns an error and any retries
+// have been exhausted (default HandlerErrorNoAck).
+func (o *ClientOptions) SetHandlerErrorPolicy(p HandlerErrorPolicy) *ClientOptions {
+	o.HandlerErrorPolicy = p
+	return o
+}
+
+// SetHandlerErrorHandler sets the function that will be called each time a MessageHandlerE returns an error.
+func (o *ClientOptions) SetHandlerErrorHandler(h HandlerErrorHandler) *ClientOptions {
+	o.OnHandlerError = h
+	return o
+}
+
+// SetDedupStore sets the store used by the ExactlyOnce middleware to record the messages processed and the period
+// for which they are remembered (a message redelivered after this may be processed again; if window is 0 the
+// default of 1 hour is used). As brokers reuse packet IDs, a longer window increases the chance of a redelivered
+// message being mistaken for an earlier one with the same content. Use a persistent store (e.g.
+// NewFileDedupStore) to detect duplicates delivered after the process restarts; a fixed ClientID is also required.
+func (o *ClientOptions) SetDedupStore(s DedupStore, window time.Duration) *ClientOptions {
+	o.DedupStore = s
+	if window > 0 {
+		o.DedupWindow = window
+	}
+	return o
+}
+
+// SetQos2DeliverOnPubrel, if true, causes inbound QoS 2 messages to be held in the Store (PUBREC is sent
+// immediately) and passed to handlers when the broker sends PUBREL; PUBCOMP is sent once the message has been
+// acknowledged. This ensures that a message resent by the broker (with DUP set) is not passed to handlers twice
+// and, if CleanSession is false and a persistent Store is used, held messages survive a restart. Note that a
+// message may still be passed to handlers again if the connection is lost before it is acknowledged (see
+// ExactlyOnce). By default (false) messages are passed to handlers when the PUBLISH is received.
+func (o *ClientOptions) SetQos2DeliverOnPubrel(onPubrel bool) *ClientOptions {
+	o.Qos2DeliverOnPubrel = onPubrel
+	return o
+}
+
+// SetRouteParams, if true, allows the topics passed to AddRoute, Subscribe, Unsubscribe etc. to be route patterns
+// containing named parameters (see ParamMessage). This is off by default because a level such as {id} is a valid
+// literal topic level (which, when enabled, would be subscribed to as +).
+func (o *ClientOptions) SetRouteParams(enabled bool) *ClientOptions {
+	o.RouteParams = enabled
+	return o
+}
+
+// SetHandlerPanicHandler sets the function that will be called when a MessageHandler panics. Panics in
+// handlers are always recovered (and logged to ERROR) so that they do not terminate the application.
+func (o *ClientOptions) SetHandlerPanicHandler(h HandlerPanicHandler) *ClientOptions {
+	o.OnHandlerPanic = h
+	return o
+}
+
+// SetHandlerPanicPolicy sets what happens to a message whose handler panicked (default HandlerPanicAck).
+func (o *ClientOptions) SetHandlerPanicPolicy(p HandlerPanicPolicy) *ClientOptions {
+	o.HandlerPanicPolicy = p
+	return o
+}
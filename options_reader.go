@@ -81,6 +81,12 @@ func (r *ClientOptionsReader) Password() string {
 	return s
 }
 
+// AuthProvider returns the AuthProvider in use (if any)
+func (r *ClientOptionsReader) AuthProvider() AuthProvider {
+	s := r.options.AuthProvider
+	return s
+}
+
 // CleanSession returns whether Cleansession is set
 func (r *ClientOptionsReader) CleanSession() bool {
 	s := r.options.CleanSession
@@ -127,6 +133,56 @@ func (r *ClientOptionsReader) TLSConfig() *tls.Config {
 	return s
 }
 
+// TLSReloader returns the TLSReloader in use (if any); this can be used to check the expiry of the certificate
+// used to establish the current connection (TLSReloader.ActiveExpiry)
+func (r *ClientOptionsReader) TLSReloader() *TLSReloader {
+	s := r.options.TLSReloader
+	return s
+}
+
+// TopicPolicy returns the TopicPolicy in use (if any)
+func (r *ClientOptionsReader) TopicPolicy() *TopicPolicy {
+	s := r.options.TopicPolicy
+	return s
+}
+
+// EchoSuppressionWindow returns the period for which published messages are tracked to suppress their echo (0 if
+// echo suppression is disabled)
+func (r *ClientOptionsReader) EchoSuppressionWindow() time.Duration {
+	s := r.options.EchoSuppressionWindow
+	return s
+}
+
+// LocalDelivery returns true if published messages are delivered to the clients own routes
+func (r *ClientOptionsReader) LocalDelivery() bool {
+	s := r.options.LocalDelivery
+	return s
+}
+
+// AckTimeout returns the period within which messages must be acknowledged when AutoAckDisabled is set
+func (r *ClientOptionsReader) AckTimeout() time.Duration {
+	s := r.options.AckTimeout
+	return s
+}
+
+// OrderedAcks returns true if manual acknowledgements are released in the order the messages were received
+func (r *ClientOptionsReader) OrderedAcks() bool {
+	s := r.options.OrderedAcks
+	return s
+}
+
+// DeadLetterTopic returns the topic dead-lettered messages are published to ("" if they are not published)
+func (r *ClientOptionsReader) DeadLetterTopic() string {
+	s := r.options.DeadLetterTopic
+	return s
+}
+
+// DeadLetterStore returns the Store dead-lettered messages are written to (if any)
+func (r *ClientOptionsReader) DeadLetterStore() Store {
+	s := r.options.DeadLetterStore
+	return s
+}
+
 func (r *ClientOptionsReader) KeepAlive() time.Duration {
 	s := time.Duration(r.options.KeepAlive * int64(time.Second))
 	return s
@@ -228,7 +228,7 @@ func NewControlPacketWithHeader(fh FixedHeader) (ControlPacket, error) {
 	case Pingresp:
 		return &PingrespPacket{FixedHeader: fh}, nil
 	}
-	return nil, fmt.Errorf("unsupported packet type 0x%x", fh.MessageType)
+	return nil, fmt.Errorf("%w: unsupported packet type 0x%x", ErrorProtocolViolation, fh.MessageType)
 }
 
 // Details struct returned by the Details() function called on
@@ -0,0 +1,116 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"strings"
+)
+
+// ParamMessage is implemented by the messages passed to handlers registered with a route pattern that contains
+// named parameters. If enabled with SetRouteParams, route patterns (passed to AddRoute, Subscribe etc.) may
+// include levels of the form {name}, which match a single level (as per +), and a final level of the form #name,
+// which matches any number of levels (as per #). For example:
+//
+//	site/{site}/device/{id}/#rest
+//
+// is subscribed to as site/+/device/+/# and, when a message is received on site/s1/device/d7/temp/inside, the
+// handler can retrieve site=s1, id=d7 and rest=temp/inside with Param (or TopicParam).
+type ParamMessage interface {
+	Message
+	// Param returns the value of the named parameter ("" if the parameter does not exist)
+	Param(name string) string
+	// Params returns all parameters
+	Params() map[string]string
+}
+
+// TopicParam returns the value of the named parameter extracted from the topic of m (or "" if m was not routed
+// via a pattern containing the parameter)
+func TopicParam(m Message, name string) string {
+	if pm, ok := m.(ParamMessage); ok {
+		return pm.Param(name)
+	}
+	return ""
+}
+
+// paramMessage wraps a Message adding the parameters extracted from its topic
+type paramMessage struct {
+	Message
+	params map[string]string
+}
+
+func (m *paramMessage) Param(name string) string {
+	return m.params[name]
+}
+
+func (m *paramMessage) Params() map[string]string {
+	return m.params
+}
+
+// routePattern returns pattern as a topic filter (with parameter names) if route parameters are enabled,
+// otherwise pattern is returned unchanged
+func (r *router) routePattern(pattern string) (string, []string) {
+	if !r.params {
+		return pattern, nil
+	}
+	return parseRoutePattern(pattern)
+}
+
+// parseRoutePattern converts a route pattern into an MQTT topic filter. If the pattern contains named
+// parameters the name of the parameter at each level of the filter ("" if the level is not a parameter) is also
+// returned; as with topic.Match, levels relating to $share are excluded.
+func parseRoutePattern(pattern string) (string, []string) {
+	if !strings.ContainsAny(pattern, "{#") {
+		return pattern, nil
+	}
+	levels := strings.Split(pattern, "/")
+	names := make([]string, len(levels))
+	found := false
+	for i, l := range levels {
+		switch {
+		case len(l) > 2 && l[0] == '{' && l[len(l)-1] == '}' && !strings.ContainsAny(l[1:len(l)-1], "{}"):
+			names[i], levels[i] = l[1:len(l)-1], "+"
+		case len(l) > 1 && l[0] == '#' && i == len(levels)-1:
+			names[i], levels[i] = l[1:], "#"
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return pattern, nil
+	}
+	if levels[0] == "$share" && len(names) > 2 {
+		names = names[2:]
+	}
+	return strings.Join(levels, "/"), names
+}
+
+// withTopicParams wraps handler so that it is passed a ParamMessage containing the parameters named in names
+// (as returned by parseRoutePattern)
+func withTopicParams(names []string, handler MessageHandler) MessageHandler {
+	return func(c Client, m Message) {
+		levels := strings.Split(m.Topic(), "/")
+		params := make(map[string]string, len(names))
+		for i, name := range names {
+			switch {
+			case name == "":
+			case i == len(names)-1 && i <= len(levels): // # (which may match the parent level, i.e. nothing)
+				params[name] = strings.Join(levels[i:], "/")
+			case i < len(levels):
+				params[name] = levels[i]
+			}
+		}
+		handler(c, &paramMessage{Message: m, params: params})
+	}
+}
@@ -19,7 +19,6 @@
 package mqtt
 
 import (
-	"errors"
 	"io"
 	"sync/atomic"
 	"time"
@@ -70,7 +69,7 @@ func keepalive(c *client, conn io.Writer) {
 			}
 			if atomic.LoadInt32(&c.pingOutstanding) > 0 && time.Since(pingSent) >= c.options.PingTimeout {
 				CRITICAL.Println(PNG, "pingresp not received, disconnecting")
-				c.internalConnLost(errors.New("pingresp not received, disconnecting")) // no harm in calling this if the connection is already down (or shutdown is in progress)
+				c.internalConnLost(ErrPingTimeout) // no harm in calling this if the connection is already down (or shutdown is in progress)
 				return
 			}
 		}
@@ -0,0 +1,144 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/eclipse/paho.mqtt.golang/topic"
+)
+
+// ErrPolicyDenied is wrapped by all PolicyError's
+var ErrPolicyDenied = errors.New("denied by topic policy")
+
+// TopicRule permits access to the topics matching Filter; a rule that only sets Filter permits any QoS and (when
+// publishing) retained messages.
+type TopicRule struct {
+	Filter     string // Topic filter (wildcards permitted)
+	LimitQos   bool   // If true the QoS is limited to MaxQos
+	MaxQos     byte   // Highest QoS that may be used (when publishing or subscribing) if LimitQos is set
+	DenyRetain bool   // Retained messages may not be published (only relevant to publish rules)
+}
+
+// TopicACL is a list of allow rules and deny filters
+type TopicACL struct {
+	// Allow lists the topics that are permitted; if empty everything not denied is permitted (with any QoS and
+	// retain flag). Each rule may also limit the QoS and retain flag (see TopicRule). When publishing the topic
+	// must match the rule filter and when subscribing the filter
+	// subscribed to must be a subset of the rule filter (e.g. a rule for a/# permits a subscription to a/b/+).
+	Allow []TopicRule
+	// Deny lists topic filters that are not permitted (this takes precedence over Allow). When subscribing, a
+	// filter that overlaps a deny filter is denied (e.g. denying a/secret denies a subscription to a/+ or #).
+	Deny []string
+}
+
+// TopicPolicy restricts the topics the client can publish and subscribe to; this is enforced by the client before
+// anything is sent to the broker (so is not a replacement for access control in the broker, but can prevent a
+// misbehaving component from affecting others using the same client). Routes added with AddRoute are checked
+// against the Subscribe rules. Denied operations fail with a *PolicyError and are counted in ClientStats.
+type TopicPolicy struct {
+	Publish   TopicACL
+	Subscribe TopicACL
+}
+
+// PolicyError is returned when an operation is denied by the TopicPolicy
+type PolicyError struct {
+	Op     string // "publish", "subscribe" or "route"
+	Topic  string // Topic name (publish) or filter (subscribe/route)
+	Reason string
+}
+
+// Error returns details of the operation that was denied
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s to %q %s: %s", e.Op, e.Topic, ErrPolicyDenied, e.Reason)
+}
+
+// Unwrap returns ErrPolicyDenied
+func (e *PolicyError) Unwrap() error {
+	return ErrPolicyDenied
+}
+
+// checkPublish returns a *PolicyError if publishing to the topic name is not permitted
+func (p *TopicPolicy) checkPublish(name string, qos byte, retained bool) error {
+	for _, f := range p.Publish.Deny {
+		if topic.Match(f, name) {
+			return &PolicyError{Op: "publish", Topic: name, Reason: "matches deny filter " + f}
+		}
+	}
+	if len(p.Publish.Allow) == 0 {
+		return nil
+	}
+	reason := "no allow rule matches"
+	for _, r := range p.Publish.Allow {
+		switch {
+		case !topic.Match(r.Filter, name):
+		case r.LimitQos && qos > r.MaxQos:
+			reason = fmt.Sprintf("QoS %d exceeds maximum of %d (rule %s)", qos, r.MaxQos, r.Filter)
+		case retained && r.DenyRetain:
+			reason = "retained messages not permitted (rule " + r.Filter + ")"
+		default:
+			return nil
+		}
+	}
+	return &PolicyError{Op: "publish", Topic: name, Reason: reason}
+}
+
+// checkSubscribe returns a *PolicyError if subscribing to filter is not permitted (op is used in the error)
+func (p *TopicPolicy) checkSubscribe(op string, filter string, qos byte) error {
+	for _, f := range p.Subscribe.Deny {
+		if topic.Overlap(f, filter) {
+			return &PolicyError{Op: op, Topic: filter, Reason: "overlaps deny filter " + f}
+		}
+	}
+	if len(p.Subscribe.Allow) == 0 {
+		return nil
+	}
+	reason := "no allow rule matches"
+	for _, r := range p.Subscribe.Allow {
+		switch {
+		case !topic.Subset(filter, r.Filter):
+		case r.LimitQos && qos > r.MaxQos:
+			reason = fmt.Sprintf("QoS %d exceeds maximum of %d (rule %s)", qos, r.MaxQos, r.Filter)
+		default:
+			return nil
+		}
+	}
+	return &PolicyError{Op: op, Topic: filter, Reason: reason}
+}
+
+// checkPublishPolicy applies the TopicPolicy (if any) to a publish
+func (c *client) checkPublishPolicy(name string, qos byte, retained bool) error {
+	if c.options.TopicPolicy == nil {
+		return nil
+	}
+	return c.policyResult(c.options.TopicPolicy.checkPublish(name, qos, retained))
+}
+
+// checkSubscribePolicy applies the TopicPolicy (if any) to a subscription (or route if op is "route")
+func (c *client) checkSubscribePolicy(op string, filter string, qos byte) error {
+	if c.options.TopicPolicy == nil {
+		return nil
+	}
+	return c.policyResult(c.options.TopicPolicy.checkSubscribe(op, filter, qos))
+}
+
+// policyResult logs and counts denials
+func (c *client) policyResult(err error) error {
+	if err != nil {
+		c.policyDenials.Add(1)
+		WARN.Println(CLI, err)
+	}
+	return err
+}
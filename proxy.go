@@ -0,0 +1,192 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// Proxy support
+//
+// ClientOptions.Proxy is called (with a request whose URL is the broker URL) before each connection is established
+// and returns the proxy to use (nil = connect directly). The following proxy URL schemes are supported:
+//   http://[user:password@]host[:port]   - HTTP CONNECT (basic authentication is used if a user is provided)
+//   https://[user:password@]host[:port]  - HTTP CONNECT over a TLS connection to the proxy
+//   socks5://[user:password@]host[:port] - SOCKS5 (socks5h is also accepted)
+
+// ProxyFromEnvironment returns the URL of the proxy to use when connecting to the broker in req.URL. The proxy is
+// determined from the environment variables MQTT_PROXY, ALL_PROXY (for WebSocket connections HTTPS_PROXY and
+// HTTP_PROXY are checked first) or the lowercase versions thereof. NO_PROXY is honoured in the same way as
+// http.ProxyFromEnvironment.
+//
+// A nil URL and nil error are returned if no proxy is defined or a proxy should not be used for the request.
+func ProxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	proxyEnv := getEnvAny("MQTT_PROXY", "mqtt_proxy", "ALL_PROXY", "all_proxy")
+	cfg := &httpproxy.Config{
+		HTTPProxy:  proxyEnv,
+		HTTPSProxy: proxyEnv,
+		NoProxy:    getEnvAny("NO_PROXY", "no_proxy"),
+	}
+	target := *req.URL
+	switch target.Scheme {
+	case "ws":
+		cfg.HTTPProxy = getEnvAny("HTTP_PROXY", "http_proxy", "MQTT_PROXY", "mqtt_proxy", "ALL_PROXY", "all_proxy")
+		target.Scheme = "http"
+	case "wss":
+		cfg.HTTPSProxy = getEnvAny("HTTPS_PROXY", "https_proxy", "MQTT_PROXY", "mqtt_proxy", "ALL_PROXY", "all_proxy")
+		target.Scheme = "https"
+	default:
+		// httpproxy only supports http/https URLs; the scheme is only used to select the proxy and default port
+		// (MQTT broker URLs should always include the port)
+		target.Scheme = "https"
+	}
+	return cfg.ProxyFunc()(&target)
+}
+
+// ProxyURL returns a ProxyFunction (for use with SetProxy) that always returns the same URL
+func ProxyURL(fixedURL *url.URL) ProxyFunction {
+	return func(*http.Request) (*url.URL, error) {
+		return fixedURL, nil
+	}
+}
+
+// getEnvAny returns the value of the first of the environment variables that is set (and not empty)
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if val := os.Getenv(n); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// proxyForBroker calls proxyFn to determine the proxy to use when connecting to uri (nil if a direct connection
+// should be made)
+func proxyForBroker(proxyFn ProxyFunction, uri *url.URL, headers http.Header) (*url.URL, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    uri,
+		Header: headers,
+		Host:   uri.Host,
+	}
+	return proxyFn(req)
+}
+
+// dialViaProxy establishes a connection to addr via the proxy at proxyURL
+func dialViaProxy(proxyURL *url.URL, addr string, dialer *net.Dialer) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return dialHTTPConnect(proxyURL, addr, dialer)
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			auth = &proxy.Auth{User: proxyURL.User.Username()}
+			auth.Password, _ = proxyURL.User.Password()
+		}
+		d, err := proxy.SOCKS5("tcp", hostWithDefaultPort(proxyURL, "1080"), auth, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return d.Dial("tcp", addr)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+}
+
+// dialHTTPConnect establishes a connection to addr using the HTTP CONNECT method
+func dialHTTPConnect(proxyURL *url.URL, addr string, dialer *net.Dialer) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxyURL.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostWithDefaultPort(proxyURL, "443"), &tls.Config{ServerName: proxyURL.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", hostWithDefaultPort(proxyURL, "80"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{"User-Agent": []string{"paho.mqtt.golang"}},
+	}
+	if proxyURL.User != nil {
+		pwd, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + pwd))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if dialer.Timeout > 0 { // Ensure that the handshake with the proxy does not block indefinitely
+		if err = conn.SetDeadline(time.Now().Add(dialer.Timeout)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", addr, resp.Status)
+	}
+	if dialer.Timeout > 0 {
+		if err = conn.SetDeadline(time.Time{}); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if br.Buffered() > 0 { // Should not happen (the broker will not send anything until we do) but just in case...
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// hostWithDefaultPort returns u.Host adding the port provided if none is specified
+func hostWithDefaultPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// bufferedConn is a net.Conn where some data has already been read into a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the buffer (and then the connection)
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,112 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Inbound QoS 2 messages are, by default, passed to the router when the PUBLISH is received and PUBREC is sent once
+// the message has been acknowledged (method B in the spec). If Qos2DeliverOnPubrel is set, PUBREC is sent as soon
+// as the PUBLISH is received (and stored), but the message is only passed to the router when PUBREL is received;
+// PUBCOMP is sent once the message has been acknowledged (method A). As the broker discards the message when it
+// receives PUBREC, any resent PUBLISH (with DUP set) is not delivered twice.
+
+// heldInbound tracks the inbound QoS 2 messages held in the store awaiting PUBREL
+type heldInbound struct {
+	mu  sync.Mutex
+	ids map[uint16]bool // false = awaiting PUBREL, true = passed to router (awaiting acknowledgement)
+}
+
+// loadHeldInbound populates c.held with the QoS 2 messages in the store (these will be delivered if the broker
+// sends PUBREL). Must be called before comms are started.
+func (c *client) loadHeldInbound() {
+	c.held.mu.Lock()
+	defer c.held.mu.Unlock()
+	c.held.ids = make(map[uint16]bool)
+	if c.options.CleanSession { // the store will be reset
+		return
+	}
+	for _, key := range c.persist.All() {
+		if !isKeyInbound(key) {
+			continue
+		}
+		if p, ok := c.persist.Get(key).(*packets.PublishPacket); ok && p.Qos == 2 {
+			c.held.ids[p.MessageID] = false
+		}
+	}
+}
+
+// holdInbound returns true if the PUBLISH should be held until PUBREL is received
+func (c *client) holdInbound(p *packets.PublishPacket) bool {
+	if !c.options.Qos2DeliverOnPubrel || p.Qos != 2 {
+		return false
+	}
+	c.held.mu.Lock()
+	defer c.held.mu.Unlock()
+	if _, ok := c.held.ids[p.MessageID]; !ok {
+		c.held.ids[p.MessageID] = false
+	}
+	return true
+}
+
+// releaseInbound is called when PUBREL is received; it returns the PUBLISH to be delivered (if any). held is true if
+// the message is being held (in which case PUBCOMP will be sent once it is acknowledged).
+func (c *client) releaseInbound(id uint16) (p *packets.PublishPacket, held bool) {
+	if !c.options.Qos2DeliverOnPubrel {
+		return nil, false
+	}
+	c.held.mu.Lock()
+	defer c.held.mu.Unlock()
+	released, ok := c.held.ids[id]
+	if !ok {
+		return nil, false
+	}
+	if released { // already passed to the router
+		return nil, true
+	}
+	if p, _ = c.persist.Get(inboundKeyFromMID(id)).(*packets.PublishPacket); p == nil {
+		ERROR.Println(NET, "held QoS 2 message not found in store, id:", id)
+		delete(c.held.ids, id)
+		return nil, false
+	}
+	c.held.ids[id] = true
+	return p, true
+}
+
+// isHeld returns true if the message with the specified id is being held
+func (c *client) isHeld(id uint16) bool {
+	c.held.mu.Lock()
+	defer c.held.mu.Unlock()
+	_, ok := c.held.ids[id]
+	return ok
+}
+
+// pubcompFunc is used in place of ackFunc for QoS 2 messages delivered on receipt of PUBREL. The message is removed
+// from the store even if the PUBCOMP is dropped by send because the connection has gone (the broker will resend
+// PUBREL when the session is resumed, and PUBCOMP is then sent immediately).
+func pubcompFunc(send func(*PacketAndToken), c *client, packet *packets.PublishPacket) func() {
+	return func() {
+		pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		pc.MessageID = packet.MessageID
+		persistOutbound(c.persist, pc) // removes the message from the store
+		c.held.mu.Lock()
+		delete(c.held.ids, packet.MessageID)
+		c.held.mu.Unlock()
+		DEBUG.Println(NET, "putting pubcomp msg on obound")
+		send(&PacketAndToken{p: pc, t: nil})
+	}
+}
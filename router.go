@@ -20,6 +20,8 @@ package mqtt
 
 import (
 	"container/list"
+	"fmt"
+	"runtime/debug"
 	"strings"
 	"sync"
 
@@ -30,8 +32,11 @@ import (
 // callback to be executed upon the arrival of a message associated
 // with a subscription to that topic.
 type route struct {
-	topic    string
-	callback MessageHandler
+	topic      string
+	callback   MessageHandler
+	middleware []MessageMiddleware // applied to callback (before the router middleware)
+	owner      *Subscription       // non-nil if the route belongs to a Subscription handle
+	params     []string            // parameter names (see parseRoutePattern); nil if the route pattern had none
 }
 
 // match takes a slice of strings which represent the route being tested having been split on '/'
@@ -58,6 +63,9 @@ func match(route []string, topic []string) bool {
 	return false
 }
 
+// routeIncludesTopic returns true if the topic name matches the route. Note that, unlike topic.Match, routes
+// beginning with a wildcard match topics beginning with $ (the broker determines which messages are received,
+// so a route such as # is expected to handle everything)
 func routeIncludesTopic(route, topic string) bool {
 	return match(routeSplit(route), strings.Split(topic, "/"))
 }
@@ -76,15 +84,18 @@ func routeSplit(route string) []string {
 
 // match takes the topic string of the published message and does a basic compare to the
 // string of the current Route, if they match it returns true
-func (r *route) match(topic string) bool {
-	return r.topic == topic || routeIncludesTopic(r.topic, topic)
+func (r *route) match(name string) bool {
+	return r.topic == name || routeIncludesTopic(r.topic, name)
 }
 
 type router struct {
 	sync.RWMutex
 	routes         *list.List
 	defaultHandler MessageHandler
+	middleware     []MessageMiddleware // applied to every handler (including the defaultHandler)
+	stats          dispatchStats
 	messages       chan *packets.PublishPacket
+	params         bool // route patterns may contain named parameters (see ClientOptions.SetRouteParams)
 }
 
 // newRouter returns a new instance of a Router and channel which can be used to tell the Router
@@ -96,27 +107,54 @@ func newRouter() *router {
 
 // addRoute takes a topic string and MessageHandler callback. It looks in the current list of
 // routes to see if there is already a matching Route. If there is it replaces the current
-// callback with the new one. If not it add a new entry to the list of Routes.
-func (r *router) addRoute(topic string, callback MessageHandler) {
+// callback (and middleware) with the new one. If not it add a new entry to the list of Routes.
+// Routes belonging to Subscription handles are not replaced. topic may be a route pattern containing
+// named parameters (see routePattern).
+func (r *router) addRoute(topic string, callback MessageHandler, middleware ...MessageMiddleware) {
+	topic, params := r.routePattern(topic)
 	r.Lock()
 	defer r.Unlock()
 	for e := r.routes.Front(); e != nil; e = e.Next() {
-		if e.Value.(*route).topic == topic {
+		if e.Value.(*route).topic == topic && e.Value.(*route).owner == nil {
 			r := e.Value.(*route)
 			r.callback = callback
+			r.middleware = middleware
+			r.params = params
 			return
 		}
 	}
-	r.routes.PushBack(&route{topic: topic, callback: callback})
+	r.routes.PushBack(&route{topic: topic, callback: callback, middleware: middleware, params: params})
 }
 
 // deleteRoute takes a route string, looks for a matching Route in the list of Routes. If
-// found it removes the Route from the list.
+// found it removes the Route from the list (routes belonging to Subscription handles are left).
 func (r *router) deleteRoute(topic string) {
+	topic, _ = r.routePattern(topic)
 	r.Lock()
 	defer r.Unlock()
 	for e := r.routes.Front(); e != nil; e = e.Next() {
-		if e.Value.(*route).topic == topic {
+		if e.Value.(*route).topic == topic && e.Value.(*route).owner == nil {
+			r.routes.Remove(e)
+			return
+		}
+	}
+}
+
+// addSubscriptionRoute adds a route for the Subscription handle; unlike addRoute any number of
+// handles may share the same topic.
+func (r *router) addSubscriptionRoute(topic string, s *Subscription) {
+	topic, params := r.routePattern(topic)
+	r.Lock()
+	defer r.Unlock()
+	r.routes.PushBack(&route{topic: topic, callback: s.deliver, owner: s, params: params})
+}
+
+// deleteSubscriptionRoute removes the route belonging to the Subscription handle
+func (r *router) deleteSubscriptionRoute(s *Subscription) {
+	r.Lock()
+	defer r.Unlock()
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		if e.Value.(*route).owner == s {
 			r.routes.Remove(e)
 			return
 		}
@@ -131,109 +169,206 @@ func (r *router) setDefaultHandler(handler MessageHandler) {
 	r.defaultHandler = handler
 }
 
+// use adds middleware that will be applied to all handlers (including the default handler)
+func (r *router) use(middleware ...MessageMiddleware) {
+	r.Lock()
+	defer r.Unlock()
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// handler returns the callback for the route wrapped in the route and router middleware (which
+// will receive a ParamMessage if the route pattern contained parameters)
+// Note: r must be read locked
+func (r *router) handler(rt *route) MessageHandler {
+	h := ChainMiddleware(ChainMiddleware(rt.callback, rt.middleware...), r.middleware...)
+	if rt.params != nil {
+		h = withTopicParams(rt.params, h)
+	}
+	return h
+}
+
 // matchAndDispatch takes a channel of Message pointers as input and starts a go routine that
 // takes messages off the channel, matches them against the internal route list and calls the
 // associated callback (or the defaultHandler, if one exists and no other route matched). If
 // anything is sent down the stop channel the function will end.
 func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order bool, client *client) <-chan *PacketAndToken {
-	var wg sync.WaitGroup
+	keyed := client.options.KeyedDispatchWorkers > 0 // keyed dispatch runs handlers in goroutines so order must be false
+	if keyed {
+		order = false
+	}
 	ackOutChan := make(chan *PacketAndToken) // Channel returned to caller; closed when messages channel closed
-	var ackInChan chan *PacketAndToken       // ACKs generated by ackFunc get put onto this channel
-
+	// ACKs generated by ackFunc are put onto ackInChan and copied to ackOutChan. As messages may be acknowledged
+	// at any time (e.g. by a handler that has not returned, or the application when AutoAckDisabled is set)
+	// ackInChan is never closed; ACKs sent once the copy has stopped are dropped (see sendAck).
+	ackInChan := make(chan *PacketAndToken)
 	stopAckCopy := make(chan struct{})    // Closure requests stop of go routine copying ackInChan to ackOutChan
-	ackCopyStopped := make(chan struct{}) // Closure indicates that it is safe to close ackOutChan
-	goRoutinesDone := make(chan struct{}) // closed on wg.Done()
-	if order {
-		ackInChan = ackOutChan // When order = true no go routines are used so safe to use one channel and close when done
-	} else {
-		// When order = false ACK messages are sent in go routines so ackInChan cannot be closed until all goroutines done
-		ackInChan = make(chan *PacketAndToken)
-		go func() { // go routine to copy from ackInChan to ackOutChan until stopped
-			for {
-				select {
-				case a := <-ackInChan:
-					ackOutChan <- a
-				case <-stopAckCopy:
-					close(ackCopyStopped) // Signal main go routine that it is safe to close ackOutChan
-					for {
-						select {
-						case <-ackInChan: // drain ackInChan to ensure all goRoutines can complete cleanly (ACK dropped)
-							DEBUG.Println(ROU, "matchAndDispatch received acknowledgment after processing stopped (ACK dropped).")
-						case <-goRoutinesDone:
-							close(ackInChan) // Nothing further should be sent (a panic is probably better than silent failure)
-							DEBUG.Println(ROU, "matchAndDispatch order=false copy goroutine exiting.")
-							return
-						}
-					}
-				}
+	ackCopyStopped := make(chan struct{}) // Closure indicates that it is safe to close ackOutChan (and ACKs will be dropped)
+	sendAck := func(p *PacketAndToken) {
+		select {
+		case ackInChan <- p:
+		case <-ackCopyStopped:
+			DEBUG.Println(ROU, "matchAndDispatch received acknowledgment after processing stopped (ACK dropped).")
+		}
+	}
+	client.goTracked(func() { // go routine to copy from ackInChan to ackOutChan until stopped
+		for {
+			select {
+			case a := <-ackInChan:
+				ackOutChan <- a
+			case <-stopAckCopy:
+				close(ackCopyStopped) // Signal main go routine that it is safe to close ackOutChan
+				DEBUG.Println(ROU, "matchAndDispatch ACK copy goroutine exiting.")
+				return
 			}
-		}()
+		}
+	})
+
+	var pool *dispatchPool      // nil if a goroutine is to be started for each handler
+	var sequencer *ackSequencer // keeps ACKs in order (keyed dispatch or OrderedAcks) and runs AckTimeout timers
+	if keyed || client.options.AutoAckDisabled {
+		sequencer = newAckSequencer(keyed || client.options.OrderedAcks)
+	}
+	keyFn := client.options.KeyedDispatchKey
+	switch {
+	case keyed:
+		pool = newDispatchPool(client.options.KeyedDispatchWorkers, client.options.DispatchQueueDepth, true, &r.stats, client.goTracked)
+		if keyFn == nil {
+			keyFn = TopicDispatchKey
+		}
+	case !order && client.options.DispatchWorkers > 0:
+		pool = newDispatchPool(client.options.DispatchWorkers, client.options.DispatchQueueDepth, false, &r.stats, client.goTracked)
 	}
 
-	go func() { // Main go routine handling inbound messages
+	client.goTracked(func() { // Main go routine handling inbound messages
 		for message := range messages {
 			// DEBUG.Println(ROU, "matchAndDispatch received message")
+			r.stats.received.Add(1)
 			sent := false
 			r.RLock()
-			m := messageFromPublish(message, ackFunc(ackInChan, client.persist, message))
 			var handlers []MessageHandler
 			for e := r.routes.Front(); e != nil; e = e.Next() {
 				if e.Value.(*route).match(message.TopicName) {
-					if order {
-						handlers = append(handlers, e.Value.(*route).callback)
-					} else {
-						hd := e.Value.(*route).callback
-						wg.Add(1)
-						go func() {
-							hd(client, m)
-							if !client.options.AutoAckDisabled {
-								m.Ack()
-							}
-							wg.Done()
-						}()
-					}
+					handlers = append(handlers, r.handler(e.Value.(*route)))
 					sent = true
 				}
 			}
-			if !sent {
-				if r.defaultHandler != nil {
-					if order {
-						handlers = append(handlers, r.defaultHandler)
-					} else {
-						wg.Add(1)
-						go func() {
-							r.defaultHandler(client, m)
-							if !client.options.AutoAckDisabled {
-								m.Ack()
-							}
-							wg.Done()
-						}()
+			if !sent && r.defaultHandler != nil {
+				handlers = append(handlers, ChainMiddleware(r.defaultHandler, r.middleware...))
+			}
+			r.RUnlock() // Must be released before dispatching as handlers may add routes (and the pool may block)
+			if client.echoes != nil && client.echoes.consume(message.TopicName, message.Payload) {
+				// The message is still acknowledged in the usual way (so ACKs remain in order)
+				DEBUG.Println(ROU, "matchAndDispatch suppressed echo of own publish, topic:", message.TopicName)
+				handlers = []MessageHandler{suppressEcho}
+			}
+			ack := ackFunc(sendAck, client.persist, message)
+			if message.Qos == 2 && client.options.Qos2DeliverOnPubrel { // the message was released by PUBREL
+				ack = pubcompFunc(sendAck, client, message)
+			}
+			m := messageFromPublish(message, ack)
+			if sequencer != nil && m.qos > 0 { // The spec requires that ACKs be sent in the order messages were received (see SetOrderedAcks)
+				client.sequenceAck(sequencer, m)
+			}
+			// stats.pending is only decremented once the message is counted as active or queued (see Shutdown)
+			if len(handlers) == 0 {
+				client.unroutable(m) // acks or abandons (releasing the sequence slot) so that later ACKs are not held up
+				r.stats.pending.Add(-1)
+				continue
+			}
+			if keyed { // all handlers for a message are called, in turn, by the worker for its key
+				pool.enqueue(keyFn(m), func() {
+					for _, hd := range handlers {
+						r.invokeHandler(client, hd, m)
 					}
-				} else {
-					DEBUG.Println(ROU, "matchAndDispatch received message and no handler was available. Message will NOT be acknowledged.")
+				})
+				r.stats.pending.Add(-1)
+				continue
+			}
+			if order {
+				r.stats.active.Add(1)
+				r.stats.pending.Add(-1)
+				for _, handler := range handlers {
+					invokeHandler(client, handler, m)
 				}
+				r.stats.active.Add(-1)
+				continue
 			}
-			r.RUnlock()
 			for _, handler := range handlers {
-				handler(client, m)
-				if !client.options.AutoAckDisabled {
-					m.Ack()
+				hd := handler
+				if pool != nil {
+					pool.enqueue("", func() { // blocks when the queue is full (so we stop reading from the network)
+						r.invokeHandler(client, hd, m)
+					})
+					continue
 				}
+				r.stats.active.Add(1) // counted from now as the goroutine may not start immediately
+				client.goTracked(func() {
+					invokeHandler(client, hd, m)
+					r.stats.active.Add(-1)
+				})
 			}
+			r.stats.pending.Add(-1)
 			// DEBUG.Println(ROU, "matchAndDispatch handled message")
 		}
-		if order {
-			close(ackOutChan)
-		} else { // Ensure that nothing further will be written to ackOutChan before closing it
-			close(stopAckCopy)
-			<-ackCopyStopped
-			close(ackOutChan)
-			go func() {
-				wg.Wait() // Note: If this remains running then the user has handlers that are not returning
-				close(goRoutinesDone)
-			}()
+		if pool != nil {
+			pool.stop() // queued jobs will still be run (ACKs will be dropped)
 		}
+		if sequencer != nil {
+			sequencer.stop() // ACKs held for (and AckTimeout timers of) messages from this connection are discarded
+		}
+		close(stopAckCopy) // Ensure that nothing further will be written to ackOutChan before closing it
+		<-ackCopyStopped
+		close(ackOutChan)
 		DEBUG.Println(ROU, "matchAndDispatch exiting")
-	}()
+	})
 	return ackOutChan
 }
+
+// invokeHandler calls the handler (see invokeHandler) keeping track of the number active
+func (r *router) invokeHandler(client *client, handler MessageHandler, m Message) {
+	r.stats.active.Add(1)
+	defer r.stats.active.Add(-1)
+	invokeHandler(client, handler, m)
+}
+
+// invokeHandler calls handler and then acknowledges the message (unless AutoAckDisabled is set). If the handler
+// panics then the panic is recovered, reported to the HandlerPanicHandler and the HandlerPanicPolicy applied.
+func invokeHandler(client *client, handler MessageHandler, m Message) {
+	if recovered, stack, panicked := callHandler(client, handler, m); panicked {
+		ERROR.Println(ROU, "message handler panicked, topic:", m.Topic(), "id:", m.MessageID(), "panic:", recovered, string(stack))
+		if client.options.OnHandlerPanic != nil {
+			client.options.OnHandlerPanic(client, m, recovered, stack)
+		}
+		client.deadLetter(m, DeadLetterHandlerPanic, fmt.Errorf("%v", recovered))
+		switch client.options.HandlerPanicPolicy {
+		case HandlerPanicNoAck:
+			abandon(m)
+			return
+		case HandlerPanicDisconnect:
+			abandon(m)
+			client.internalConnLost(fmt.Errorf("%w (topic: %s, id: %d): %v", ErrHandlerPanic, m.Topic(), m.MessageID(), recovered))
+			return
+		}
+	}
+	if !client.options.AutoAckDisabled {
+		m.Ack()
+	}
+}
+
+// abandon indicates that m will not be acknowledged (so any later acknowledgements are not held up waiting for it)
+func abandon(m Message) {
+	if mm, ok := m.(*message); ok {
+		mm.abandon()
+	}
+}
+
+// callHandler calls handler recovering from any panic
+func callHandler(client *client, handler MessageHandler, m Message) (recovered interface{}, stack []byte, panicked bool) {
+	defer func() {
+		if recovered = recover(); recovered != nil {
+			stack, panicked = debug.Stack(), true
+		}
+	}()
+	handler(client, m)
+	return nil, nil, false
+}
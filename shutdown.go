@@ -0,0 +1,136 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ErrShuttingDown is returned by Publish when called after Shutdown
+var ErrShuttingDown = errors.New("client is shutting down")
+
+// shutdownPollInterval is how often Shutdown checks whether message handlers have completed
+const shutdownPollInterval = 10 * time.Millisecond
+
+// ShutdownError is returned by Shutdown when it was unable to complete all outstanding work
+type ShutdownError struct {
+	Err           error // context error (nil if the context did not expire)
+	PendingTokens int   // Publish tokens that had not completed
+	// HandlersActive is the number of message handlers still running (or queued) and messages received but not yet
+	// dispatched
+	HandlersActive int64
+	// Undelivered holds the outbound PUBLISH packets remaining in the Store (these will be resent if the session is
+	// resumed). This is everything in the Store so, if CleanSession is false and the Store is persistent, it may
+	// include messages published by a previous client that have not yet been delivered.
+	Undelivered []*packets.PublishPacket
+}
+
+// Error summarises the work left outstanding
+func (e *ShutdownError) Error() string {
+	var parts []string
+	if e.PendingTokens > 0 {
+		parts = append(parts, fmt.Sprintf("%d publish(es) incomplete", e.PendingTokens))
+	}
+	if len(e.Undelivered) > 0 {
+		ids := make([]string, len(e.Undelivered))
+		for i, p := range e.Undelivered {
+			ids[i] = fmt.Sprint(p.MessageID)
+		}
+		parts = append(parts, fmt.Sprintf("%d message(s) undelivered in store (ids %s)", len(e.Undelivered),
+			strings.Join(ids, ", ")))
+	}
+	if e.HandlersActive > 0 {
+		parts = append(parts, fmt.Sprintf("%d message handler(s) still running", e.HandlersActive))
+	}
+	msg := "shutdown incomplete: " + strings.Join(parts, ", ")
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the context error (if any)
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// Shutdown gracefully disconnects from the broker. Publish will fail with ErrShuttingDown once Shutdown has been
+// called; Shutdown then waits for outstanding publish tokens to complete and message handlers to return (including
+// those for messages that have been read from the network but not yet dispatched), or ctx to expire, before sending
+// DISCONNECT (if ctx has expired DISCONNECT is still attempted but may not be sent). Returns nil if everything
+// completed, otherwise a *ShutdownError describing what was left outstanding (note that any messages remaining in
+// the Store are reported, see ShutdownError.Undelivered).
+//
+// Shutdown must not be called from a message handler (it would wait for itself).
+func (c *client) Shutdown(ctx context.Context) error {
+	c.shuttingDown.Store(true)
+	DEBUG.Println(CLI, "shutting down")
+	for _, t := range c.messageIds.publishTokens() {
+		select {
+		case <-t.Done():
+		case <-ctx.Done():
+		}
+	}
+	r := &c.msgRouter.stats
+	busy := func() int64 { return r.pending.Load() + r.active.Load() + r.queued.Load() }
+	for busy() > 0 && ctx.Err() == nil {
+		select {
+		case <-time.After(shutdownPollInterval):
+		case <-ctx.Done():
+		}
+	}
+
+	e := &ShutdownError{Err: ctx.Err(), HandlersActive: busy()}
+	for _, t := range c.messageIds.publishTokens() {
+		select {
+		case <-t.Done():
+		default:
+			e.PendingTokens++
+		}
+	}
+	if c.storeOpen.Load() { // including when the connection has been lost (the messages will be sent on reconnect)
+		e.Undelivered = c.undelivered()
+	}
+	c.disconnectCtx(ctx)
+	if e.Err == nil && e.PendingTokens == 0 && e.HandlersActive == 0 && len(e.Undelivered) == 0 {
+		return nil
+	}
+	return e
+}
+
+// publishReceived counts a message read from the network until the router dispatches it (nothing between the
+// comms goroutines and the router drops messages, so the count will always be decremented)
+func (c *client) publishReceived() {
+	c.msgRouter.stats.pending.Add(1)
+}
+
+// undelivered returns the outbound PUBLISH packets in the store
+func (c *client) undelivered() []*packets.PublishPacket {
+	var pubs []*packets.PublishPacket
+	for _, key := range c.persist.All() {
+		if !isKeyOutbound(key) {
+			continue
+		}
+		if p, ok := c.persist.Get(key).(*packets.PublishPacket); ok {
+			pubs = append(pubs, p)
+		}
+	}
+	return pubs
+}
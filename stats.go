@@ -0,0 +1,63 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+// ClientStats provides a snapshot of the clients internal counters (see Client.Stats)
+type ClientStats struct {
+	MessagesReceived       uint64 // PUBLISH packets passed to the router (since the client was created)
+	HandlersActive         int64  // Message handlers currently running
+	DispatchQueueLength    int64  // Handlers waiting for a dispatch worker (see SetDispatchWorkers)
+	DispatchQueueHighWater int64  // Maximum value DispatchQueueLength has reached
+	DispatchQueueCapacity  int    // Maximum queue length (before reading from the network is paused)
+	DispatchWorkers        int    // Number of dispatch workers (0 = a goroutine is started for each handler)
+	KeyedDispatch          bool   // true if keyed dispatch is in use (each worker has its own queue)
+	PolicyDenials          uint64 // Operations denied by the TopicPolicy
+	EchoesSuppressed       uint64 // Messages received that were identified as our own publishes (see SetEchoSuppression)
+	AckTimeouts            uint64 // Messages not acknowledged within the AckTimeout
+	DeadLetters            uint64 // Messages dead-lettered (see SetDeadLetterHandler)
+	HandlerErrors          uint64 // Errors returned by MessageHandlerE's (see HandleErrors)
+	HandlerRetries         uint64 // Calls to MessageHandlerE's that were retries
+	DuplicatesDropped      uint64 // Duplicate messages not passed to handlers (see ExactlyOnce)
+	PublishCallbacksQueued int    // PublishAsync callbacks waiting to be run
+	OutsideNamespace       uint64 // Messages dropped as their topic was outside the namespace (see NewNamespacedClient)
+}
+
+// Stats returns a snapshot of the clients internal counters
+func (c *client) Stats() ClientStats {
+	s := &c.msgRouter.stats
+	cs := ClientStats{
+		MessagesReceived:       s.received.Load(),
+		HandlersActive:         s.active.Load(),
+		DispatchQueueLength:    s.queued.Load(),
+		DispatchQueueHighWater: s.highWater.Load(),
+		DispatchQueueCapacity:  c.options.DispatchQueueDepth,
+		DispatchWorkers:        c.options.DispatchWorkers,
+		PolicyDenials:          c.policyDenials.Load(),
+		AckTimeouts:            c.ackTimeouts.Load(),
+		DeadLetters:            c.deadLetters.Load(),
+		HandlerErrors:          c.handlerErrors.Load(),
+		HandlerRetries:         c.handlerRetries.Load(),
+		DuplicatesDropped:      c.duplicates.Load(),
+		PublishCallbacksQueued: c.callbacks.len(),
+	}
+	if c.echoes != nil {
+		cs.EchoesSuppressed = c.echoes.suppressed.Load()
+	}
+	if c.options.KeyedDispatchWorkers > 0 {
+		cs.KeyedDispatch = true
+		cs.DispatchWorkers = c.options.KeyedDispatchWorkers
+		cs.DispatchQueueCapacity = c.options.DispatchQueueDepth * c.options.KeyedDispatchWorkers
+	}
+	return cs
+}
@@ -21,13 +21,15 @@ package mqtt
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 const (
-	inboundPrefix  = "i."
-	outboundPrefix = "o."
+	inboundPrefix    = "i."
+	outboundPrefix   = "o."
+	quarantinePrefix = "q." // prepended to the key of packets that are retained in the store but will not be sent
 )
 
 // Store is an interface which can be used to provide implementations
@@ -46,9 +48,9 @@ type Store interface {
 }
 
 // A key MUST have the form "X.[messageid]"
-// where X is 'i' or 'o'
+// where X is 'i' or 'o' (optionally prefixed with "q."), or "dl.[sequence].[messageid]" in a dead-letter store
 func mIDFromKey(key string) uint16 {
-	s := key[2:]
+	s := key[strings.LastIndexByte(key, '.')+1:]
 	i, err := strconv.ParseUint(s, 10, 16)
 	chkerr(err)
 	return uint16(i)
@@ -64,6 +66,19 @@ func isKeyInbound(key string) bool {
 	return key[:2] == inboundPrefix
 }
 
+// Return true if the key is that of a quarantined packet
+func isKeyQuarantined(key string) bool {
+	return strings.HasPrefix(key, quarantinePrefix)
+}
+
+// quarantine moves the packet stored under key to a quarantine key ("q." + key); the packet is retained (so it
+// can be inspected) but will not be sent
+func quarantine(s Store, key string, m packets.ControlPacket, reason error) {
+	ERROR.Println(STR, fmt.Sprintf("quarantining stored packet %s (%s): %s", key, m.String(), reason))
+	s.Put(quarantinePrefix+key, m)
+	s.Del(key)
+}
+
 // Return a string of the form "i.[id]"
 func inboundKeyFromMID(id uint16) string {
 	return fmt.Sprintf("%s%d", inboundPrefix, id)
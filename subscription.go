@@ -0,0 +1,203 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Subscription is a handle to a subscription created with Client.SubscribeWithHandle; it owns the
+// handler for the subscription so multiple components can subscribe to the same topic filter without
+// replacing each others handlers. The client keeps a count of the handles for each filter and only
+// sends an UNSUBSCRIBE when the last one is released. A plain Subscribe to the same filter counts as
+// one further holder (released by a plain Unsubscribe, which will not unsubscribe whilst handles remain);
+// the QoS requested is the highest of those requested by the holders.
+//
+// Messages received whilst the subscription is paused are discarded (but still acknowledged).
+type Subscription struct {
+	client  *client
+	topic   string
+	qos     byte
+	handler MessageHandler
+
+	paused   atomic.Bool
+	released atomic.Bool
+	received atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+// Topic returns the topic filter subscribed to
+func (s *Subscription) Topic() string {
+	return s.topic
+}
+
+// Qos returns the QoS requested when subscribing
+func (s *Subscription) Qos() byte {
+	return s.qos
+}
+
+// Pause stops messages being passed to the handler until Resume is called; the subscription with the
+// broker is not changed (so messages will be received, and counted as dropped, whilst paused)
+func (s *Subscription) Pause() {
+	s.paused.Store(true)
+}
+
+// Resume restarts delivery of messages to the handler
+func (s *Subscription) Resume() {
+	s.paused.Store(false)
+}
+
+// Paused returns true if the subscription is paused
+func (s *Subscription) Paused() bool {
+	return s.paused.Load()
+}
+
+// Received returns the number of messages received for this subscription (including those dropped)
+func (s *Subscription) Received() uint64 {
+	return s.received.Load()
+}
+
+// Dropped returns the number of messages that were not passed to the handler (e.g. because the
+// subscription was paused)
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Unsubscribe releases the handle; the handler will not be called again. If this was the last handle
+// for the topic filter an UNSUBSCRIBE is sent (and the returned token tracks it), otherwise the
+// returned token is already complete (as it is if the handle has already been released).
+func (s *Subscription) Unsubscribe() Token {
+	if s.detach() != 0 {
+		token := newToken(packets.Unsubscribe)
+		token.flowComplete()
+		return token
+	}
+	return s.client.unsubscribe(false, s.topic)
+}
+
+// deliver is the MessageHandler for the route belonging to the subscription
+func (s *Subscription) deliver(c Client, m Message) {
+	s.received.Add(1)
+	if s.paused.Load() {
+		s.dropped.Add(1)
+		return
+	}
+	s.handler(c, m)
+}
+
+// detach removes the route and releases the handle, returning the number of holders (handles and any plain
+// Subscribe) remaining for the topic filter. If the handle had already been released -1 is returned.
+func (s *Subscription) detach() int {
+	if !s.released.CompareAndSwap(false, true) {
+		return -1
+	}
+	c := s.client
+	c.msgRouter.deleteSubscriptionRoute(s)
+	c.subHandlesMu.Lock()
+	defer c.subHandlesMu.Unlock()
+	handles := c.subHandles[s.topic]
+	for i, h := range handles {
+		if h == s {
+			handles = append(handles[:i], handles[i+1:]...)
+			break
+		}
+	}
+	if len(handles) == 0 {
+		delete(c.subHandles, s.topic)
+	} else {
+		c.subHandles[s.topic] = handles
+	}
+	if _, ok := c.subPlain[s.topic]; ok {
+		return len(handles) + 1
+	}
+	return len(handles)
+}
+
+// holdPlain records a Subscribe (without a handle) to topic, returning the QoS to request; this is the
+// highest of qos and that requested by any handles so that their subscription is not downgraded.
+func (c *client) holdPlain(topic string, qos byte) byte {
+	c.subHandlesMu.Lock()
+	defer c.subHandlesMu.Unlock()
+	if c.subPlain == nil {
+		c.subPlain = make(map[string]byte)
+	}
+	c.subPlain[topic] = qos
+	for _, h := range c.subHandles[topic] {
+		if h.qos > qos {
+			qos = h.qos
+		}
+	}
+	return qos
+}
+
+// releasePlain forgets any Subscribe to topics, returning those that are not held by a Subscription handle
+// (and so should be unsubscribed)
+func (c *client) releasePlain(topics []string) []string {
+	c.subHandlesMu.Lock()
+	defer c.subHandlesMu.Unlock()
+	unheld := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		delete(c.subPlain, topic)
+		if len(c.subHandles[topic]) == 0 {
+			unheld = append(unheld, topic)
+		} else {
+			WARN.Println(CLI, "not unsubscribing from", topic, "as Subscription handles remain")
+		}
+	}
+	return unheld
+}
+
+// SubscribeWithHandle subscribes to topic with messages being passed to callback (which must not be nil).
+// If other handles exist for the topic the SUBSCRIBE is sent with the highest QoS requested, so that an
+// existing subscription is not downgraded. The returned token tracks the SUBSCRIBE; if this fails the
+// handle should be released with Unsubscribe.
+func (c *client) SubscribeWithHandle(topic string, qos byte, callback MessageHandler) (*Subscription, Token) {
+	pattern := topic
+	topic, _ = c.msgRouter.routePattern(topic)
+	s := &Subscription{client: c, topic: topic, qos: qos, handler: callback}
+	if callback == nil {
+		s.released.Store(true)
+		token := newToken(packets.Subscribe)
+		token.setError(errors.New("callback must not be nil"))
+		return s, token
+	}
+
+	c.subHandlesMu.Lock()
+	if c.subHandles == nil {
+		c.subHandles = make(map[string][]*Subscription)
+	}
+	for _, h := range c.subHandles[topic] {
+		if h.qos > qos {
+			qos = h.qos
+		}
+	}
+	if q, ok := c.subPlain[topic]; ok && q > qos {
+		qos = q
+	}
+	c.subHandles[topic] = append(c.subHandles[topic], s)
+	c.subHandlesMu.Unlock()
+
+	token := c.subscribe(pattern, qos, nil, s)
+	select {
+	case <-token.Done(): // Failures detected before the SUBSCRIBE is sent mean the handle is of no use
+		if token.Error() != nil {
+			s.detach()
+		}
+	default:
+	}
+	return s, token
+}
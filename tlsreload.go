@@ -0,0 +1,287 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrTLSCertificateChanged is passed to the ConnectionLostHandler when the connection is dropped because the
+// TLSReloader detected a new certificate (see TLSReloader.SetReconnectOnChange)
+var ErrTLSCertificateChanged = errors.New("tls certificate changed; reconnecting")
+
+// ErrTLSCertificateExpiring is passed to the ConnectionLostHandler when the connection is dropped because the
+// certificate in use is about to expire and a replacement is available (see TLSReloader.SetReconnectBeforeExpiry)
+var ErrTLSCertificateExpiring = errors.New("tls certificate nearing expiry; reconnecting")
+
+// TLSConfigProvider returns the TLS configuration (certificates and, optionally, RootCAs) to use for the next
+// connection attempt. Only Certificates and RootCAs are taken from the returned config.
+type TLSConfigProvider func() (*tls.Config, error)
+
+// TLSReloader loads the client certificate (and optionally the CA pool) from disk, or from a TLSConfigProvider,
+// and reloads it when it changes. Pass the reloader to ClientOptions.SetTLSReloader; the most recently loaded
+// certificate will then be used for each connection attempt (combined with any TLSConfig set in ClientOptions).
+//
+// Whilst connected the client checks for changes (see SetCheckInterval) and can, optionally, drop the connection
+// (after sending DISCONNECT so the will is not published) in order to reconnect with the new certificate. This
+// requires AutoReconnect.
+type TLSReloader struct {
+	certFile, keyFile, caFile string
+	provider                  TLSConfigProvider
+
+	checkInterval         time.Duration
+	reconnectOnChange     bool
+	reconnectBeforeExpiry time.Duration
+
+	mu          sync.RWMutex
+	certs       []tls.Certificate
+	rootCAs     *x509.CertPool
+	expiry      time.Time // NotAfter of the leaf certificate (zero if no certificate)
+	fingerprint [sha256.Size]byte
+	active      [sha256.Size]byte // fingerprint of the certificate used for the last successful connection
+	activeExp   time.Time
+}
+
+// NewTLSReloader creates a TLSReloader that loads a PEM encoded certificate/key pair (and, if caFile is not
+// empty, a PEM encoded CA bundle that will be used as RootCAs). The files are loaded immediately and an error
+// returned if this fails.
+func NewTLSReloader(certFile, keyFile, caFile string) (*TLSReloader, error) {
+	r := &TLSReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		caFile:        caFile,
+		checkInterval: time.Minute,
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewTLSReloaderFromProvider creates a TLSReloader that calls provider to retrieve the current certificates.
+// provider is called immediately (an error is returned if this fails) and then whenever a check is performed.
+func NewTLSReloaderFromProvider(provider TLSConfigProvider) (*TLSReloader, error) {
+	r := &TLSReloader{
+		provider:      provider,
+		checkInterval: time.Minute,
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetCheckInterval sets how often the certificate is checked for changes while connected (default 1 minute).
+// A duration of 0 disables checking while connected (the certificate will still be reloaded before each
+// connection attempt).
+func (r *TLSReloader) SetCheckInterval(d time.Duration) *TLSReloader {
+	r.checkInterval = d
+	return r
+}
+
+// SetReconnectOnChange sets whether the client should reconnect when a new certificate is detected (default false
+// meaning that the new certificate will be used next time a connection is established).
+func (r *TLSReloader) SetReconnectOnChange(reconnect bool) *TLSReloader {
+	r.reconnectOnChange = reconnect
+	return r
+}
+
+// SetReconnectBeforeExpiry causes the client to reconnect when the certificate in use will expire within d and
+// a different certificate is available (0, the default, disables this).
+func (r *TLSReloader) SetReconnectBeforeExpiry(d time.Duration) *TLSReloader {
+	r.reconnectBeforeExpiry = d
+	return r
+}
+
+// Reload loads the certificates, returning true if they differ from those previously loaded. If an error is
+// returned then the previously loaded certificates remain in use.
+func (r *TLSReloader) Reload() (bool, error) {
+	var certs []tls.Certificate
+	var rootCAs *x509.CertPool
+	var fp [sha256.Size]byte
+
+	if r.provider != nil {
+		cfg, err := r.provider()
+		if err != nil {
+			return false, err
+		}
+		if cfg == nil {
+			return false, errors.New("tls config provider returned nil config")
+		}
+		certs, rootCAs = cfg.Certificates, cfg.RootCAs
+		h := sha256.New()
+		for _, c := range certs {
+			for _, der := range c.Certificate {
+				h.Write(der)
+			}
+		}
+		copy(fp[:], h.Sum(nil)) // RootCAs are compared separately (CertPool.Equal)
+	} else {
+		certPEM, err := os.ReadFile(r.certFile)
+		if err != nil {
+			return false, err
+		}
+		keyPEM, err := os.ReadFile(r.keyFile)
+		if err != nil {
+			return false, err
+		}
+		var caPEM []byte
+		if r.caFile != "" {
+			if caPEM, err = os.ReadFile(r.caFile); err != nil {
+				return false, err
+			}
+		}
+		fp = sha256.Sum256(bytes.Join([][]byte{certPEM, keyPEM, caPEM}, []byte{0}))
+
+		r.mu.RLock()
+		unchanged := fp == r.fingerprint && r.certs != nil
+		r.mu.RUnlock()
+		if unchanged {
+			return false, nil
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return false, err
+		}
+		certs = []tls.Certificate{cert}
+		if len(caPEM) > 0 {
+			rootCAs = x509.NewCertPool()
+			if !rootCAs.AppendCertsFromPEM(caPEM) {
+				return false, fmt.Errorf("no certificates found in %s", r.caFile)
+			}
+		}
+	}
+
+	var expiry time.Time
+	if len(certs) > 0 && len(certs[0].Certificate) > 0 {
+		leaf, err := x509.ParseCertificate(certs[0].Certificate[0])
+		if err != nil {
+			return false, err
+		}
+		expiry = leaf.NotAfter
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if fp == r.fingerprint && r.certs != nil && (r.provider == nil || rootCAs.Equal(r.rootCAs)) {
+		return false, nil
+	}
+	r.certs, r.rootCAs, r.expiry, r.fingerprint = certs, rootCAs, expiry, fp
+	DEBUG.Println(CLI, "tls certificates loaded, expiry", expiry)
+	return true, nil
+}
+
+// TLSConfig returns a copy of base (which may be nil) with the most recently loaded certificates (and RootCAs, if
+// loaded) applied.
+func (r *TLSReloader) TLSConfig(base *tls.Config) *tls.Config {
+	var cfg *tls.Config
+	if base != nil {
+		cfg = base.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cfg.Certificates = r.certs
+	if r.rootCAs != nil {
+		cfg.RootCAs = r.rootCAs
+	}
+	return cfg
+}
+
+// connectionConfig returns the tls.Config to use for a connection attempt along with a function that should be
+// called if the connection is successfully established
+func (r *TLSReloader) connectionConfig(base *tls.Config) (*tls.Config, func()) {
+	if _, err := r.Reload(); err != nil {
+		ERROR.Println(CLI, "tls certificate reload failed (previous certificate retained)", err)
+	}
+	cfg := r.TLSConfig(base)
+	r.mu.RLock()
+	fp, exp := r.fingerprint, r.expiry
+	r.mu.RUnlock()
+	return cfg, func() {
+		r.mu.Lock()
+		r.active, r.activeExp = fp, exp
+		r.mu.Unlock()
+	}
+}
+
+// Expiry returns the expiry time (NotAfter) of the most recently loaded certificate
+func (r *TLSReloader) Expiry() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.expiry
+}
+
+// ActiveExpiry returns the expiry time of the certificate used to establish the most recent successful connection
+// (zero if no connection has been established)
+func (r *TLSReloader) ActiveExpiry() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.activeExp
+}
+
+// reconnectReason checks whether the connection should be re-established; returns nil if not
+func (r *TLSReloader) reconnectReason(changed bool) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.fingerprint == r.active {
+		if r.reconnectBeforeExpiry > 0 && !r.activeExp.IsZero() && time.Until(r.activeExp) < r.reconnectBeforeExpiry {
+			WARN.Println(CLI, "tls certificate expires at", r.activeExp, "and no replacement is available")
+		}
+		return nil
+	}
+	if changed && r.reconnectOnChange {
+		return ErrTLSCertificateChanged
+	}
+	if r.reconnectBeforeExpiry > 0 && !r.activeExp.IsZero() && time.Until(r.activeExp) < r.reconnectBeforeExpiry {
+		return ErrTLSCertificateExpiring
+	}
+	return nil
+}
+
+// watchTLSReloader checks for updated certificates while the connection is up (reconnecting if configured to do so)
+func watchTLSReloader(c *client, r *TLSReloader) {
+	defer c.workers.Done()
+	DEBUG.Println(CLI, "tls reloader watch starting")
+	ticker := time.NewTicker(r.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			DEBUG.Println(CLI, "tls reloader watch stopped")
+			return
+		case <-ticker.C:
+			changed, err := r.Reload()
+			if err != nil {
+				ERROR.Println(CLI, "tls certificate reload failed (previous certificate retained)", err)
+				continue
+			}
+			if why := r.reconnectReason(changed); why != nil {
+				WARN.Println(CLI, why.Error())
+				c.reconnectGracefully(why)
+				return
+			}
+		}
+	}
+}
@@ -68,9 +68,10 @@ type tokenCompletor interface {
 }
 
 type baseToken struct {
-	m        sync.RWMutex
-	complete chan struct{}
-	err      error
+	m          sync.RWMutex
+	complete   chan struct{}
+	err        error
+	onComplete func() // called (once) when the flow completes; must not block (see PublishAsync)
 }
 
 // Wait implements the Token Wait method.
@@ -104,6 +105,9 @@ func (b *baseToken) flowComplete() {
 	case <-b.complete:
 	default:
 		close(b.complete)
+		if b.onComplete != nil {
+			b.onComplete()
+		}
 	}
 }
 
@@ -116,8 +120,8 @@ func (b *baseToken) Error() error {
 func (b *baseToken) setError(e error) {
 	b.m.Lock()
 	b.err = e
-	b.flowComplete()
 	b.m.Unlock()
+	b.flowComplete() // after unlocking as onComplete may call Error
 }
 
 func newToken(tType byte) tokenCompletor {
@@ -20,7 +20,9 @@ package mqtt
 
 import (
 	"errors"
-	"strings"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/topic"
 )
 
 // ErrInvalidQos is the error returned when an packet is to be sent
@@ -29,12 +31,12 @@ var ErrInvalidQos = errors.New("invalid QoS")
 
 // ErrInvalidTopicEmptyString is the error returned when a topic string
 // is passed in that is 0 length
-var ErrInvalidTopicEmptyString = errors.New("invalid Topic; empty string")
+var ErrInvalidTopicEmptyString = topic.ErrEmpty
 
 // ErrInvalidTopicMultilevel is the error returned when a topic string
 // is passed in that has the multi level wildcard in any position but
 // the last
-var ErrInvalidTopicMultilevel = errors.New("invalid Topic; multi-level wildcard must be last level")
+var ErrInvalidTopicMultilevel = topic.ErrMultiLevel
 
 // Topic Names and Topic Filters
 // The MQTT v3.1.1 spec clarifies a number of ambiguities with regard
@@ -52,6 +54,7 @@ var ErrInvalidTopicMultilevel = errors.New("invalid Topic; multi-level wildcard
 // - A TopicFilter may contain any number of + (single-level) wildcards.
 // - A TopicFilter with a # will match the absence of a level
 //     Example:  a subscription to "foo/#" will match messages published to "foo".
+// These rules are implemented by the topic package.
 
 func validateSubscribeMap(subs map[string]byte) ([]string, []byte, error) {
 	if len(subs) == 0 {
@@ -71,17 +74,40 @@ func validateSubscribeMap(subs map[string]byte) ([]string, []byte, error) {
 	return topics, qoss, nil
 }
 
-func validateTopicAndQos(topic string, qos byte) error {
-	if len(topic) == 0 {
-		return ErrInvalidTopicEmptyString
+// validatePublishTopic checks that name is a valid topic name, returning a *TopicError if not
+func validatePublishTopic(name string) error {
+	if err := topic.ValidateName(name); err != nil {
+		return &TopicError{Topic: name, Err: err}
 	}
+	return nil
+}
 
-	levels := strings.Split(topic, "/")
-	for i, level := range levels {
-		if level == "#" && i != len(levels)-1 {
-			return ErrInvalidTopicMultilevel
+// validateStoredPacket checks the topics in a packet loaded from the store (which may have been written by a
+// version of this library that did not validate them)
+func validateStoredPacket(p packets.ControlPacket) error {
+	switch p := p.(type) {
+	case *packets.PublishPacket:
+		return validatePublishTopic(p.TopicName)
+	case *packets.SubscribePacket:
+		for i, t := range p.Topics {
+			if err := validateTopicAndQos(t, p.Qoss[i]); err != nil {
+				return err
+			}
+		}
+	case *packets.UnsubscribePacket:
+		for _, t := range p.Topics {
+			if err := topic.ValidateFilter(t); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
+
+func validateTopicAndQos(filter string, qos byte) error {
+	if err := topic.ValidateFilter(filter); err != nil {
+		return err
+	}
 
 	if qos > 2 {
 		return ErrInvalidQos
@@ -0,0 +1,267 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+// Package topic provides validation and matching of MQTT v3.1.1 topic names and topic filters (as used by the
+// client when routing messages to handlers).
+//
+// The rules implemented are:
+//   - Topic names and filters must be between 1 and 65535 bytes of valid UTF-8 and must not contain U+0000.
+//   - Topic names must not contain wildcards (+ or #).
+//   - In a topic filter, + matches a single level and # any number of levels (including the parent level, so
+//     "a/#" matches "a"); each must occupy an entire level and # must be the last level.
+//   - Filters starting with a wildcard do not match topic names starting with $ (e.g. $SYS/broker/uptime).
+//   - Shared subscriptions ($share/{group}/{filter}) match as per {filter}.
+package topic
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxLength is the maximum length, in bytes, of a topic name or filter
+const MaxLength = 65535
+
+// Errors returned by ValidateName and ValidateFilter
+var (
+	ErrEmpty            = errors.New("invalid Topic; empty string")
+	ErrTooLong          = errors.New("invalid Topic; longer than 65535 bytes")
+	ErrInvalidUTF8      = errors.New("invalid Topic; not valid UTF-8")
+	ErrNullCharacter    = errors.New("invalid Topic; contains U+0000")
+	ErrWildcardInName   = errors.New("invalid Topic; topic name must not contain wildcards")
+	ErrMultiLevel       = errors.New("invalid Topic; multi-level wildcard must be last level")
+	ErrWildcardLevel    = errors.New("invalid Topic; wildcard must occupy an entire level")
+	ErrInvalidSharedSub = errors.New("invalid Topic; shared subscription must be $share/{group}/{filter}")
+)
+
+const sharePrefix = "$share/"
+
+// validateCommon applies the checks common to topic names and filters
+func validateCommon(s string) error {
+	switch {
+	case len(s) == 0:
+		return ErrEmpty
+	case len(s) > MaxLength:
+		return ErrTooLong
+	case !utf8.ValidString(s):
+		return ErrInvalidUTF8
+	case strings.IndexByte(s, 0) >= 0:
+		return ErrNullCharacter
+	}
+	return nil
+}
+
+// ValidateName checks that name is a valid topic name (i.e. one that can be published to)
+func ValidateName(name string) error {
+	if err := validateCommon(name); err != nil {
+		return err
+	}
+	if strings.ContainsAny(name, "+#") {
+		return ErrWildcardInName
+	}
+	return nil
+}
+
+// ValidateFilter checks that filter is a valid topic filter (i.e. one that can be subscribed to), including
+// shared subscriptions
+func ValidateFilter(filter string) error {
+	if err := validateCommon(filter); err != nil {
+		return err
+	}
+	if strings.HasPrefix(filter, sharePrefix) {
+		group, f, _ := SplitShared(filter)
+		if group == "" || f == "" || strings.ContainsAny(group, "+#") {
+			return ErrInvalidSharedSub
+		}
+		filter = f
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return ErrMultiLevel
+		case level == "#", level == "+":
+		case strings.ContainsAny(level, "+#"):
+			return ErrWildcardLevel
+		}
+	}
+	return nil
+}
+
+// nextLevel returns the first level of s and the remainder (after the separator)
+func nextLevel(s string) (level, rest string) {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// IsShared returns true if filter is a shared subscription ($share/{group}/{filter})
+func IsShared(filter string) bool {
+	return strings.HasPrefix(filter, sharePrefix)
+}
+
+// SplitShared splits a shared subscription into the group and filter; if filter is not a shared subscription
+// it is returned unchanged (with ok false)
+func SplitShared(filter string) (group, f string, ok bool) {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return "", filter, false
+	}
+	group, f = nextLevel(filter[len(sharePrefix):])
+	return group, f, true
+}
+
+// IsSystem returns true if the topic name (or filter) begins with $ (e.g. $SYS/broker/uptime); such topics are
+// not matched by filters beginning with a wildcard
+func IsSystem(s string) bool {
+	return strings.HasPrefix(s, "$")
+}
+
+// Match returns true if the topic name matches filter. Neither is validated (see Matcher for a validated, and
+// more efficient, alternative when a filter will be used repeatedly).
+func Match(filter, name string) bool {
+	_, filter, _ = SplitShared(filter)
+	return matchLevels(strings.Split(filter, "/"), name)
+}
+
+// matchLevels returns true if the topic name matches the filter (split into levels)
+func matchLevels(filter []string, name string) bool {
+	if IsSystem(name) && len(filter) > 0 && (filter[0] == "+" || filter[0] == "#") {
+		return false
+	}
+	for i, f := range filter {
+		if f == "#" {
+			return true
+		}
+		level, rest := nextLevel(name)
+		if f != "+" && f != level {
+			return false
+		}
+		end := rest == "" && !strings.HasSuffix(name, "/")
+		if end {
+			// name has no more levels; the filter must also be finished (or end with the parent matching #)
+			return i == len(filter)-1 || (i == len(filter)-2 && filter[i+1] == "#")
+		}
+		name = rest
+	}
+	return false // name has more levels than the filter
+}
+
+// Overlap returns true if there is a topic name that would be matched by both filters. Note that, for the
+// purposes of Overlap and Subset, the (invalid) empty topic name is considered; this only affects unusual pairs
+// of filters (e.g. "+" and "/#", which only have "" in common) and errs on the side of caution.
+func Overlap(a, b string) bool {
+	_, a, _ = SplitShared(a)
+	_, b, _ = SplitShared(b)
+	al, bl := strings.Split(a, "/"), strings.Split(b, "/")
+	if wildcard(al[0]) != wildcard(bl[0]) && (IsSystem(a) || IsSystem(b)) {
+		return false // the only names matched by the literal filter begin with $ which the other cannot match
+	}
+	return overlap(al, bl)
+}
+
+func overlap(a, b []string) bool {
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return true
+	case len(a) > 0 && a[0] == "#", len(b) > 0 && b[0] == "#":
+		return true
+	case len(a) == 0, len(b) == 0:
+		return false
+	case a[0] == "+", b[0] == "+", a[0] == b[0]:
+		return overlap(a[1:], b[1:])
+	}
+	return false
+}
+
+// Subset returns true if every topic name matched by sub is also matched by filter (i.e. a subscription to
+// filter makes a subscription to sub redundant)
+func Subset(sub, filter string) bool {
+	_, sub, _ = SplitShared(sub)
+	_, filter, _ = SplitShared(filter)
+	sl, fl := strings.Split(sub, "/"), strings.Split(filter, "/")
+	if wildcard(fl[0]) && !wildcard(sl[0]) && IsSystem(sub) {
+		return false
+	}
+	if len(sl) == 1 && sl[0] == "#" {
+		sl = []string{"+", "#"} // equivalent as every name has at least one level
+	}
+	return subset(sl, fl)
+}
+
+func subset(s, f []string) bool {
+	switch {
+	case len(f) > 0 && f[0] == "#":
+		return true
+	case len(s) == 0:
+		return len(f) == 0
+	case len(f) == 0, s[0] == "#":
+		return false
+	case f[0] == "+":
+		return subset(s[1:], f[1:])
+	case s[0] == "+":
+		return false
+	}
+	return s[0] == f[0] && subset(s[1:], f[1:])
+}
+
+// wildcard returns true if the level is a wildcard
+func wildcard(level string) bool {
+	return level == "+" || level == "#"
+}
+
+// Matcher is a compiled (validated) topic filter that can be used to efficiently match topic names; it is safe
+// for concurrent use.
+type Matcher struct {
+	filter string   // as passed to Compile
+	group  string   // share group ("" if not a shared subscription)
+	levels []string // levels of the filter (excluding $share/{group})
+}
+
+// Compile validates filter and returns a Matcher for it
+func Compile(filter string) (*Matcher, error) {
+	if err := ValidateFilter(filter); err != nil {
+		return nil, err
+	}
+	group, f, _ := SplitShared(filter)
+	return &Matcher{filter: filter, group: group, levels: strings.Split(f, "/")}, nil
+}
+
+// MustCompile is as per Compile but panics if the filter is invalid
+func MustCompile(filter string) *Matcher {
+	m, err := Compile(filter)
+	if err != nil {
+		panic(`topic: Compile(` + filter + `): ` + err.Error())
+	}
+	return m
+}
+
+// Match returns true if the topic name matches the filter
+func (m *Matcher) Match(name string) bool {
+	return matchLevels(m.levels, name)
+}
+
+// Filter returns the filter (as passed to Compile)
+func (m *Matcher) Filter() string {
+	return m.filter
+}
+
+// ShareGroup returns the share group if the filter is a shared subscription (otherwise "")
+func (m *Matcher) ShareGroup() string {
+	return m.group
+}
+
+// String returns the filter
+func (m *Matcher) String() string {
+	return m.filter
+}
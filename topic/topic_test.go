@@ -0,0 +1,214 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package topic
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// genFilter is a valid topic filter built from a small alphabet (so that matches are likely)
+type genFilter string
+
+func (genFilter) Generate(r *rand.Rand, _ int) reflect.Value {
+	levels := make([]string, 1+r.Intn(3))
+	for i := range levels {
+		levels[i] = []string{"a", "b", "$s", "", "+", "#"}[r.Intn(6)]
+		if levels[i] == "#" && i != len(levels)-1 {
+			levels[i] = "+"
+		}
+	}
+	if levels[0] == "" && len(levels) == 1 {
+		levels[0] = "a" // an empty filter is invalid
+	}
+	return reflect.ValueOf(genFilter(strings.Join(levels, "/")))
+}
+
+// genName is a valid topic name built from the same alphabet as genFilter
+type genName string
+
+func (genName) Generate(r *rand.Rand, _ int) reflect.Value {
+	levels := make([]string, 1+r.Intn(4))
+	for i := range levels {
+		levels[i] = []string{"a", "b", "$s", ""}[r.Intn(4)]
+	}
+	if levels[0] == "" && len(levels) == 1 {
+		levels[0] = "a" // an empty name is invalid
+	}
+	return reflect.ValueOf(genName(strings.Join(levels, "/")))
+}
+
+// allNames returns every name of up to four levels built from the genName alphabet (including "", see Overlap)
+func allNames() []string {
+	names := []string{""}
+	var all []string
+	for i := 0; i < 4; i++ {
+		var next []string
+		for _, n := range names {
+			for _, l := range []string{"a", "b", "$s", ""} {
+				if i == 0 {
+					next = append(next, l)
+				} else {
+					next = append(next, n+"/"+l)
+				}
+			}
+		}
+		all = append(all, next...)
+		names = next
+	}
+	return all
+}
+
+// refMatch is a straightforward implementation of the matching rules
+func refMatch(filter, name string) bool {
+	f, n := strings.Split(filter, "/"), strings.Split(name, "/")
+	if strings.HasPrefix(name, "$") && (f[0] == "+" || f[0] == "#") {
+		return false
+	}
+	var match func(f, n []string) bool
+	match = func(f, n []string) bool {
+		switch {
+		case len(f) == 0:
+			return len(n) == 0
+		case f[0] == "#":
+			return true
+		case len(n) == 0:
+			return false
+		case f[0] == "+" || f[0] == n[0]:
+			return match(f[1:], n[1:])
+		}
+		return false
+	}
+	return match(f, n)
+}
+
+var quickConfig = &quick.Config{MaxCount: 2000}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, name string
+		exp          bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/+", "a", false},
+		{"+/+", "/a", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"$share/group/a/+", "a/b", true},
+		{"A", "a", false},
+	}
+	for _, test := range tests {
+		if got := Match(test.filter, test.name); got != test.exp {
+			t.Errorf("Match(%q, %q) = %t", test.filter, test.name, got)
+		}
+	}
+
+	if err := quick.Check(func(f genFilter, n genName) bool {
+		return Match(string(f), string(n)) == refMatch(string(f), string(n)) &&
+			MustCompile(string(f)).Match(string(n)) == Match(string(f), string(n))
+	}, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOverlapSubset(t *testing.T) {
+	names := allNames()
+	if err := quick.Check(func(a, b genFilter) bool {
+		overlap, subset := false, true
+		for _, n := range names {
+			ma, mb := Match(string(a), n), Match(string(b), n)
+			overlap = overlap || (ma && mb)
+			subset = subset && (!ma || mb)
+		}
+		if Overlap(string(a), string(b)) != overlap || Overlap(string(b), string(a)) != overlap {
+			t.Logf("Overlap(%q, %q) expected %t", a, b, overlap)
+			return false
+		}
+		if Subset(string(a), string(b)) != subset {
+			t.Logf("Subset(%q, %q) expected %t", a, b, subset)
+			return false
+		}
+		return true
+	}, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	long := strings.Repeat("a", MaxLength+1)
+	names := map[string]error{
+		"a/b":       nil,
+		"/":         nil,
+		"$SYS/info": nil,
+		"":          ErrEmpty,
+		long:        ErrTooLong,
+		"a\xff":     ErrInvalidUTF8,
+		"a\x00b":    ErrNullCharacter,
+		"a/+":       ErrWildcardInName,
+		"a/#":       ErrWildcardInName,
+	}
+	for name, exp := range names {
+		if err := ValidateName(name); err != exp {
+			t.Errorf("ValidateName(%.20q) = %v, expected %v", name, err, exp)
+		}
+	}
+
+	filters := map[string]error{
+		"a/+/#":         nil,
+		"+":             nil,
+		"$share/g/a/#":  nil,
+		"":              ErrEmpty,
+		long:            ErrTooLong,
+		"a/#/b":         ErrMultiLevel,
+		"a/b#":          ErrWildcardLevel,
+		"a+/b":          ErrWildcardLevel,
+		"$share/g":      ErrInvalidSharedSub,
+		"$share//a":     ErrInvalidSharedSub,
+		"$share/g+/a":   ErrInvalidSharedSub,
+		"$share/g/a/#/": ErrMultiLevel,
+	}
+	for filter, exp := range filters {
+		if err := ValidateFilter(filter); err != exp {
+			t.Errorf("ValidateFilter(%.20q) = %v, expected %v", filter, err, exp)
+		}
+		if _, err := Compile(filter); err != exp {
+			t.Errorf("Compile(%.20q) = %v, expected %v", filter, err, exp)
+		}
+	}
+
+	if err := quick.Check(func(f genFilter, n genName) bool {
+		return ValidateFilter(string(f)) == nil && ValidateName(string(n)) == nil
+	}, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSplitShared(t *testing.T) {
+	if g, f, ok := SplitShared("$share/group/a/b"); !ok || g != "group" || f != "a/b" {
+		t.Errorf("unexpected result %q %q %t", g, f, ok)
+	}
+	if g, f, ok := SplitShared("a/b"); ok || g != "" || f != "a/b" {
+		t.Errorf("unexpected result %q %q %t", g, f, ok)
+	}
+	if m := MustCompile("$share/group/a/+"); m.ShareGroup() != "group" || !m.Match("a/b") || m.Filter() != "$share/group/a/+" {
+		t.Errorf("unexpected Matcher %v", m)
+	}
+}
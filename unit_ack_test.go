@@ -0,0 +1,228 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_ManualAckOrder(t *testing.T) {
+	b := newFakeBroker()
+	received := make(chan Message, 10)
+	timedOut := make(chan uint16, 1)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetAutoAckDisabled(true).
+		SetOrderedAcks(true).
+		SetAckTimeout(300 * time.Millisecond).
+		SetAckTimeoutHandler(func(_ Client, m Message) { timedOut <- m.MessageID() }).
+		SetDefaultPublishHandler(func(_ Client, m Message) { received <- m }).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(10)
+
+	receive := func(ids ...uint16) []Message {
+		var msgs []Message
+		for _, id := range ids {
+			if err := b.publish("a/b", 1, id, "x"); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case m := <-received:
+				msgs = append(msgs, m)
+			case <-time.After(time.Second):
+				t.Fatalf("message %d not received", id)
+			}
+		}
+		return msgs
+	}
+	expectAcks := func(ids ...uint16) {
+		t.Helper()
+		for _, id := range ids {
+			if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID != id {
+				t.Fatalf("expected PUBACK %d, got %d", id, pa.MessageID)
+			}
+		}
+	}
+
+	// Acknowledgements made out of order are released in the order received
+	msgs := receive(1, 2, 3)
+	msgs[2].Ack()
+	msgs[1].Ack()
+	msgs[0].Ack()
+	expectAcks(1, 2, 3)
+
+	// A message passed to Nack is not acknowledged (and does not hold up later acknowledgements)
+	msgs = receive(4, 5)
+	if !Nack(msgs[0]) {
+		t.Fatalf("Nack not supported")
+	}
+	msgs[0].Ack() // no effect
+	msgs[1].Ack()
+	expectAcks(5)
+
+	// A message that is not acknowledged in time is reported (and abandoned)
+	msgs = receive(6, 7)
+	msgs[1].Ack()
+	select {
+	case id := <-timedOut:
+		if id != 6 {
+			t.Fatalf("unexpected message timed out %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ack timeout not reported")
+	}
+	expectAcks(7)
+	msgs[0].Ack() // no effect
+	if s := c.Stats(); s.AckTimeouts != 1 {
+		t.Errorf("expected 1 ack timeout, got %d", s.AckTimeouts)
+	}
+	if !Nack(&namespacedMessage{Message: msgs[0]}) {
+		t.Errorf("wrapped message should support Nack")
+	}
+}
+
+// Test_ManualAck_Unordered checks that, by default, a message that is not acknowledged does not hold up the
+// acknowledgement of later messages (and that the ack timeout still applies)
+func Test_ManualAck_Unordered(t *testing.T) {
+	b := newFakeBroker()
+	received := make(chan Message, 10)
+	timedOut := make(chan uint16, 1)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetAutoAckDisabled(true).
+		SetAckTimeout(100 * time.Millisecond).
+		SetAckTimeoutHandler(func(_ Client, m Message) { timedOut <- m.MessageID() }).
+		SetDefaultPublishHandler(func(_ Client, m Message) { received <- m }).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(10)
+
+	var msgs []Message
+	for id := uint16(1); id <= 3; id++ {
+		if err := b.publish("a/b", 1, id, "x"); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, <-received)
+	}
+	msgs[2].Ack() // message 1 is deliberately left unacknowledged
+	msgs[1].Ack()
+	for _, id := range []uint16{3, 2} {
+		if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID != id {
+			t.Fatalf("expected PUBACK %d, got %d", id, pa.MessageID)
+		}
+	}
+	select {
+	case id := <-timedOut:
+		if id != 1 {
+			t.Fatalf("unexpected message timed out %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ack timeout not reported")
+	}
+	msgs[0].Ack() // no effect
+	select {
+	case p := <-b.received:
+		if pa, ok := p.(*packets.PubackPacket); ok {
+			t.Errorf("unexpected PUBACK %d following ack timeout", pa.MessageID)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Test_ManualAck_Unroutable checks that a message that is not acknowledged because there is no route does not
+// hold up the acknowledgement of later messages
+func Test_ManualAck_Unroutable(t *testing.T) {
+	b := newFakeBroker()
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetAutoAckDisabled(true).
+		SetOrderedAcks(true).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	c.AddRoute("a", func(_ Client, m Message) { m.Ack() })
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(10)
+
+	if err := b.publish("nowhere", 1, 1, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.publish("a", 1, 2, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID != 2 {
+		t.Fatalf("expected PUBACK 2, got %d", pa.MessageID)
+	}
+}
+
+// Test_ManualAck_ConnectionLost checks that acknowledgements held (or made) when the connection is lost, and ack
+// timeouts that would have released them, are discarded
+func Test_ManualAck_ConnectionLost(t *testing.T) {
+	for _, order := range []bool{true, false} {
+		b := newFakeBroker()
+		received := make(chan Message, 10)
+		timedOut := make(chan uint16, 10)
+		ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+			SetProtocolVersion(4).
+			SetOrderMatters(order).
+			SetAutoAckDisabled(true).
+			SetOrderedAcks(true).
+			SetAckTimeout(100 * time.Millisecond).
+			SetAckTimeoutHandler(func(_ Client, m Message) { timedOut <- m.MessageID() }).
+			SetAutoReconnect(false).
+			SetDefaultPublishHandler(func(_ Client, m Message) { received <- m }).
+			SetCustomOpenConnectionFn(b.open)
+		c := NewClient(ops).(*client)
+		if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+			t.Fatalf("connect failed: %v", tok.Error())
+		}
+		var msgs []Message
+		for id := uint16(1); id <= 3; id++ {
+			if err := b.publish("a", 1, id, "x"); err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, <-received)
+		}
+		msgs[1].Ack() // held waiting for message 1
+		b.dropConnection()
+		for i := 0; c.status.ConnectionStatus() != disconnected; i++ {
+			if i > 100 {
+				t.Fatal("connection loss not detected")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(200 * time.Millisecond) // the ack timeout would have released the held ACK
+		msgs[2].Ack()
+		msgs[0].Ack()
+		select {
+		case id := <-timedOut:
+			t.Errorf("order %t: ack timeout reported for message %d after the connection was lost", order, id)
+		default:
+		}
+		if err := c.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+}
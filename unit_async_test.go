@@ -0,0 +1,129 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_PublishAsync(t *testing.T) {
+	before := runtime.NumGoroutine()
+	b := newFakeBroker()
+	received := make(chan string, 10)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetDefaultPublishHandler(func(_ Client, m Message) { received <- string(m.Payload()) }).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+
+	results := make(chan PublishResult, 10)
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	c.PublishAsync("a", 1, false, "blocking", func(r PublishResult) {
+		close(blocked)
+		<-release // holds up subsequent callbacks, but must not hold up the network
+		results <- r
+	})
+	nextPacket[*packets.PublishPacket](t, b)
+	<-blocked
+	for _, topic := range []string{"q0", "q1", "q2"} {
+		c.PublishAsync(topic, topic[1]-'0', false, "x", func(r PublishResult) { results <- r })
+		nextPacket[*packets.PublishPacket](t, b)
+	}
+
+	// Whilst the first callback is blocked incoming messages are still processed
+	if err := b.publish("in", 1, 1, "in"); err != nil {
+		t.Fatal(err)
+	}
+	if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID != 1 {
+		t.Fatalf("expected PUBACK 1, got %d", pa.MessageID)
+	}
+	if p := <-received; p != "in" {
+		t.Fatalf("unexpected message %s", p)
+	}
+	select {
+	case r := <-results:
+		t.Fatalf("callback ran before earlier callback completed: %+v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s := c.Stats(); s.PublishCallbacksQueued == 0 {
+		t.Errorf("expected callbacks to be queued")
+	}
+
+	close(release)
+	got := make(map[string]PublishResult)
+	for i := 0; i < 4; i++ {
+		select {
+		case r := <-results:
+			if r.Err != nil || r.Latency <= 0 || (i == 0) != (r.Topic == "a") {
+				t.Fatalf("unexpected result %d %+v", i, r)
+			}
+			got[r.Topic] = r
+		case <-time.After(time.Second):
+			t.Fatalf("callback %d not called", i)
+		}
+	}
+	if got["a"].MessageID == 0 || got["q0"].MessageID != 0 || got["q1"].MessageID == 0 || got["q2"].MessageID == 0 {
+		t.Errorf("unexpected message IDs %+v", got)
+	}
+
+	// Failures are also reported via the callback
+	c.PublishAsync("a/#", 1, false, "x", func(r PublishResult) { results <- r })
+	var te *TopicError
+	if r := <-results; !errors.As(r.Err, &te) {
+		t.Errorf("expected *TopicError, got %v", r.Err)
+	}
+
+	// A publish outstanding when the client is closed fails
+	b.noPuback.Store(true)
+	c.PublishAsync("a", 1, false, "x", func(r PublishResult) { results <- r })
+	nextPacket[*packets.PublishPacket](t, b)
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	select {
+	case r := <-results:
+		if !errors.Is(r.Err, ErrConnectionLost) {
+			t.Errorf("expected ErrConnectionLost, got %v", r.Err)
+		}
+	default:
+		t.Errorf("callback not run before Close returned")
+	}
+	checkGoroutines(t, before)
+
+	c.PublishAsync("a", 1, false, "x", func(r PublishResult) { results <- r })
+	if r := <-results; r.Err != ErrNotConnected {
+		t.Errorf("expected ErrNotConnected, got %v", r.Err)
+	}
+}
+
+func Test_PublishAsync_Panic(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	done := make(chan struct{})
+	c.PublishAsync("a", 0, false, "x", func(PublishResult) { panic("boom") })
+	c.PublishAsync("a", 0, false, "x", func(PublishResult) { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("callback not run following panic")
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// verifyJWT checks the signature on token and returns the decoded claims
+func verifyJWT(t *testing.T, token string, pub crypto.PublicKey) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token should have 3 parts, got %d", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("unable to decode signature: %s", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			t.Fatalf("RS256 signature invalid: %s", err)
+		}
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 || !ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			t.Fatalf("ES256 signature invalid")
+		}
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("unable to decode claims: %s", err)
+	}
+	claims := make(map[string]interface{})
+	if err = json.Unmarshal(body, &claims); err != nil {
+		t.Fatalf("unable to unmarshal claims: %s", err)
+	}
+	return claims
+}
+
+func Test_SignJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		token, err := SignJWT(key, map[string]interface{}{"aud": "my-project"})
+		if err != nil {
+			t.Fatalf("SignJWT(%T) failed: %s", key, err)
+		}
+		if claims := verifyJWT(t, token, key.Public()); claims["aud"] != "my-project" {
+			t.Errorf("unexpected claims %v", claims)
+		}
+	}
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if _, err = SignJWT(p384, nil); err == nil {
+		t.Errorf("expected error signing with P-384 key")
+	}
+}
+
+func Test_JWTAuthProvider(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p := NewJWTAuthProvider("unused", key, time.Hour, map[string]interface{}{"aud": "test"})
+
+	c1, err := p.Credentials(false)
+	if err != nil {
+		t.Fatalf("Credentials failed: %s", err)
+	}
+	if c1.Username != "unused" || time.Until(c1.Expiry) < 59*time.Minute {
+		t.Errorf("unexpected credentials %+v", c1)
+	}
+	claims := verifyJWT(t, c1.Password, key.Public())
+	if int64(claims["exp"].(float64)) != c1.Expiry.Unix() {
+		t.Errorf("exp claim %v does not match expiry %s", claims["exp"], c1.Expiry)
+	}
+
+	if c2, _ := p.Credentials(false); c2.Password != c1.Password {
+		t.Errorf("token should have been reused")
+	}
+	if c3, _ := p.Credentials(true); c3.Password == c1.Password {
+		t.Errorf("token should have been replaced when refresh requested")
+	}
+}
+
+func Test_AuthProvider_RetryOnRejection(t *testing.T) {
+	var mu sync.Mutex
+	var refreshes []bool
+	provider := AuthProviderFunc(func(refresh bool) (Credentials, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		refreshes = append(refreshes, refresh)
+		return Credentials{Username: "device", Password: "token" + string(rune('0'+len(refreshes)))}, nil
+	})
+
+	connects := make(chan *packets.ConnectPacket, 10)
+	rcs := []byte{packets.ErrRefusedBadUsernameOrPassword, packets.Accepted}
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetUsername("ignored").
+		SetAuthProvider(provider).
+		SetCustomOpenConnectionFn(func(uri *url.URL, options ClientOptions) (net.Conn, error) {
+			rc := rcs[0]
+			rcs = rcs[1:]
+			return fakeBrokerConn(rc, connects), nil
+		})
+	c := NewClient(ops).(*client)
+	conn, rc, _, err := c.attemptConnection()
+	if err != nil || rc != packets.Accepted {
+		t.Fatalf("expected connection, got rc %d, err %v", rc, err)
+	}
+	_ = conn.Close()
+
+	if len(refreshes) != 2 || refreshes[0] || !refreshes[1] {
+		t.Errorf("expected provider to be called without, then with, refresh; got %v", refreshes)
+	}
+	if p := <-connects; p.Username != "device" || string(p.Password) != "token1" {
+		t.Errorf("unexpected credentials in first CONNECT: %s/%s", p.Username, p.Password)
+	}
+	if p := <-connects; string(p.Password) != "token2" {
+		t.Errorf("unexpected password in second CONNECT: %s", p.Password)
+	}
+}
+
+func Test_AuthProvider_Error(t *testing.T) {
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetAuthProvider(AuthProviderFunc(func(bool) (Credentials, error) {
+			return Credentials{}, errors.New("token service unavailable")
+		})).
+		SetCustomOpenConnectionFn(func(uri *url.URL, options ClientOptions) (net.Conn, error) {
+			t.Error("connection should not be attempted without credentials")
+			return nil, errors.New("unexpected")
+		})
+	c := NewClient(ops).(*client)
+	if _, rc, _, err := c.attemptConnection(); err == nil || rc != packets.ErrNetworkError {
+		t.Errorf("expected network error, got rc %d, err %v", rc, err)
+	}
+}
+
+func Test_AuthProvider_ReconnectBeforeExpiry(t *testing.T) {
+	connects := make(chan *packets.ConnectPacket, 10)
+	lost := make(chan error, 1)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetKeepAlive(0).
+		SetAuthProvider(AuthProviderFunc(func(bool) (Credentials, error) {
+			return Credentials{Username: "device", Password: "token", Expiry: time.Now().Add(200 * time.Millisecond)}, nil
+		})).
+		SetAuthRefreshBefore(100 * time.Millisecond).
+		SetConnectionLostHandler(func(_ Client, err error) {
+			select {
+			case lost <- err:
+			default:
+			}
+		}).
+		SetCustomOpenConnectionFn(func(uri *url.URL, options ClientOptions) (net.Conn, error) {
+			return fakeBrokerConn(packets.Accepted, connects), nil
+		})
+	c := NewClient(ops).(*client)
+	c.authMinWait = 50 * time.Millisecond
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(0)
+
+	select {
+	case err := <-lost:
+		if !errors.Is(err, ErrAuthCredentialsExpiring) {
+			t.Errorf("expected ErrAuthCredentialsExpiring, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not re-established before credentials expired")
+	}
+	<-connects
+	select {
+	case <-connects: // reconnected with fresh credentials
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+}
+
+func Test_AuthRefreshWait(t *testing.T) {
+	tests := []struct {
+		remaining, before, exp time.Duration
+	}{
+		{time.Hour, time.Minute, 59 * time.Minute},
+		{time.Minute, time.Minute, 30 * time.Second}, // reused credentials (e.g. JWTAuthProvider)
+		{90 * time.Second, time.Minute, 45 * time.Second},
+		{4 * time.Second, time.Minute, authRefreshMinWait},
+		{-time.Minute, time.Minute, authRefreshMinWait}, // already expired
+		{time.Hour, 0, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := authRefreshWait(tt.remaining, tt.before, authRefreshMinWait); got != tt.exp {
+			t.Errorf("authRefreshWait(%s, %s) = %s, expected %s", tt.remaining, tt.before, got, tt.exp)
+		}
+	}
+}
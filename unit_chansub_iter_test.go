@@ -0,0 +1,43 @@
+//go:build go1.23
+
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_ChanSubscription_Messages(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	s, _ := c.SubscribeChan("a", 1, 3, OverflowBlock)
+	for _, topic := range []string{"1", "2", "3"} {
+		s.deliver(c, &message{topic: topic})
+	}
+	var got []string
+	for m := range s.Messages() {
+		got = append(got, m.Topic())
+		if len(got) == 2 {
+			break
+		}
+	}
+	s.Cancel()
+	for m := range s.Messages() { // ends when channel closed
+		got = append(got, m.Topic())
+	}
+	if fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("unexpected messages %v", got)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// drain returns the topics of all messages currently in the subscription channel
+func drain(s *ChanSubscription) []string {
+	var got []string
+	for {
+		select {
+		case m, ok := <-s.C():
+			if !ok {
+				return got
+			}
+			got = append(got, m.Topic())
+		default:
+			return got
+		}
+	}
+}
+
+func Test_ChanSubscription_Overflow(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	tests := map[OverflowPolicy]string{
+		OverflowDropNewest: "[1 2]",
+		OverflowDropOldest: "[2 3]",
+	}
+	for policy, exp := range tests {
+		s, _ := c.SubscribeChan("a", 1, 2, policy) // token will contain ErrNotConnected
+		for _, topic := range []string{"1", "2", "3"} {
+			s.deliver(c, &message{topic: topic, ack: func() {}})
+		}
+		if got := drain(s); fmt.Sprint(got) != exp {
+			t.Errorf("policy %d: expected %s, got %v", policy, exp, got)
+		}
+		if s.Dropped() != 1 {
+			t.Errorf("policy %d: expected 1 dropped, got %d", policy, s.Dropped())
+		}
+	}
+}
+
+func Test_ChanSubscription_BlockCancel(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	s, _ := c.SubscribeChan("a", 1, 0, OverflowBlock)
+	delivered := make(chan struct{})
+	go func() {
+		s.deliver(c, &message{topic: "a", ack: func() {}}) // blocks as nothing is reading
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+		t.Fatal("deliver should block when the channel is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Cancel()
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("Cancel should unblock deliver")
+	}
+	if _, ok := <-s.C(); ok {
+		t.Errorf("channel should be closed")
+	}
+	s.deliver(c, &message{topic: "a", ack: func() {}}) // must not panic after close
+	s.Cancel()                                         // nor should a second cancel
+}
+
+func Test_SubscribeChan(t *testing.T) {
+	b := newFakeBroker()
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	s, tok := c.SubscribeChan("sensors/+", 1, 10, OverflowBlock)
+	if !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	if err := b.publish("sensors/1", 1, 1, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-s.C():
+		if m.Topic() != "sensors/1" || string(m.Payload()) != "hello" {
+			t.Errorf("unexpected message %s %s", m.Topic(), m.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	c.Disconnect(100)
+	select {
+	case _, ok := <-s.C():
+		if ok {
+			t.Errorf("unexpected message")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed on Disconnect")
+	}
+}
+
+// Test_SubscribeChan_DropAck checks that messages dropped due to the OverflowPolicy are acknowledged (so, with
+// ordered manual acknowledgements, they do not hold back the acknowledgement of other messages)
+func Test_SubscribeChan_DropAck(t *testing.T) {
+	tests := map[OverflowPolicy]struct {
+		kept         uint16   // message left in the channel
+		droppedAcked []uint16 // PUBACKs expected before the kept message is acknowledged
+	}{
+		OverflowDropNewest: {kept: 1},
+		OverflowDropOldest: {kept: 3, droppedAcked: []uint16{1, 2}},
+	}
+	for policy, tt := range tests {
+		b := newFakeBroker()
+		ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+			SetProtocolVersion(4).
+			SetAutoAckDisabled(true).
+			SetOrderedAcks(true).
+			SetCustomOpenConnectionFn(b.open)
+		c := NewClient(ops).(*client)
+		if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+			t.Fatalf("connect failed: %v", tok.Error())
+		}
+		s, tok := c.SubscribeChan("a", 1, 1, policy)
+		if !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+			t.Fatalf("subscribe failed: %v", tok.Error())
+		}
+		for id := uint16(1); id <= 3; id++ {
+			if err := b.publish("a", 1, id, "x"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, id := range tt.droppedAcked {
+			if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID != id {
+				t.Errorf("policy %d: expected PUBACK %d, got %d", policy, id, pa.MessageID)
+			}
+		}
+		for i := 0; s.Dropped() != 2; i++ {
+			if i > 100 {
+				t.Fatalf("policy %d: expected 2 dropped, got %d", policy, s.Dropped())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		m := <-s.C()
+		if m.MessageID() != tt.kept {
+			t.Errorf("policy %d: expected message %d, got %d", policy, tt.kept, m.MessageID())
+		}
+		m.Ack()
+		var acked []int
+		for i := len(tt.droppedAcked); i < 3; i++ {
+			acked = append(acked, int(nextPacket[*packets.PubackPacket](t, b).MessageID))
+		}
+		sort.Ints(acked)
+		if fmt.Sprint(acked) != fmt.Sprint([]int{1, 2, 3}[len(tt.droppedAcked):]) {
+			t.Errorf("policy %d: unexpected PUBACKs %v", policy, acked)
+		}
+		_ = c.Close()
+	}
+}
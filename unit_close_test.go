@@ -0,0 +1,219 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// checkGoroutines fails the test if, within a second, the number of goroutines has not fallen to (or below) before
+func checkGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= before {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("goroutine leak: %d running, expected %d\n%s", n, before, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// idsInUse returns the number of message IDs allocated
+func idsInUse(c *client) int {
+	c.messageIds.mu.RLock()
+	defer c.messageIds.mu.RUnlock()
+	return len(c.messageIds.index)
+}
+
+func Test_Close(t *testing.T) {
+	before := runtime.NumGoroutine()
+	b := newFakeBroker()
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetOrderMatters(false).
+		SetDefaultPublishHandler(func(Client, Message) {
+			started <- struct{}{}
+			<-release
+		}).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	for i := uint16(1); i <= 3; i++ {
+		if err := b.publish("a", 1, i, "x"); err != nil {
+			t.Fatal(err)
+		}
+		<-started
+	}
+
+	closed := make(chan error)
+	go func() { closed <- c.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned (%v) whilst handlers running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Close did not return once handlers completed")
+	}
+	checkGoroutines(t, before)
+
+	if err := c.Close(); err != ErrClientClosed {
+		t.Errorf("expected ErrClientClosed from second Close, got %v", err)
+	}
+	if tok := c.Connect(); tok.Error() != ErrClientClosed {
+		t.Errorf("expected ErrClientClosed from Connect, got %v", tok.Error())
+	}
+}
+
+// Test_Close_Lifecycle runs clients with various options through connect, connection loss, reconnect and
+// disconnect cycles checking that no message IDs (or, following Close, goroutines) leak
+func Test_Close_Lifecycle(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  func(*ClientOptions)
+	}{
+		{"ordered", func(o *ClientOptions) {}},
+		{"unordered", func(o *ClientOptions) { o.SetOrderMatters(false) }},
+		{"dispatch workers", func(o *ClientOptions) { o.SetOrderMatters(false).SetDispatchWorkers(2) }},
+		{"keyed dispatch", func(o *ClientOptions) { o.SetKeyedDispatch(2, nil) }},
+		{"manual ack", func(o *ClientOptions) { o.SetOrderMatters(false).SetAutoAckDisabled(true) }},
+		{"persistent session", func(o *ClientOptions) {
+			o.SetCleanSession(false).SetMaxResumePubInFlight(1).SetKeepAlive(time.Second)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			b := newFakeBroker()
+			connected := make(chan struct{}, 10)
+			ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+				SetClientID("lifecycle").
+				SetProtocolVersion(4).
+				SetAutoReconnect(true).
+				SetMaxReconnectInterval(10 * time.Millisecond).
+				SetOnConnectHandler(func(Client) { connected <- struct{}{} }).
+				SetDefaultPublishHandler(func(_ Client, m Message) { m.Ack() }).
+				SetCustomOpenConnectionFn(b.open)
+			tt.ops(ops)
+			c := NewClient(ops).(*client)
+
+			exchange := func(cycle int) {
+				t.Helper()
+				if tok := c.Publish("out", 1, false, "x"); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+					t.Fatalf("cycle %d: publish failed: %v", cycle, tok.Error())
+				}
+				id := uint16(cycle + 1)
+				if err := b.publish("in", 1, id, "x"); err != nil {
+					t.Fatalf("cycle %d: %v", cycle, err)
+				}
+				for {
+					if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID == id {
+						break
+					}
+				}
+				if n := idsInUse(c); n != 0 {
+					t.Fatalf("cycle %d: %d message IDs in use", cycle, n)
+				}
+			}
+			awaitConnect := func(cycle int) {
+				t.Helper()
+				select {
+				case <-connected:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("cycle %d: not connected", cycle)
+				}
+			}
+
+			for cycle := 0; cycle < 3; cycle++ {
+				if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+					t.Fatalf("cycle %d: connect failed: %v", cycle, tok.Error())
+				}
+				awaitConnect(cycle)
+				exchange(cycle * 2)
+
+				b.dropConnection() // should reconnect automatically
+				awaitConnect(cycle)
+				exchange(cycle*2 + 1)
+
+				c.Disconnect(100)
+				if n := idsInUse(c); n != 0 {
+					t.Fatalf("cycle %d: %d message IDs in use after disconnect", cycle, n)
+				}
+			}
+			if err := c.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if n := c.msgRouter.stats.pending.Load(); n != 0 {
+				t.Errorf("%d messages counted as pending after Close", n)
+			}
+			checkGoroutines(t, before)
+		})
+	}
+}
+
+// Test_Close_ConnectionLost checks that Close releases tokens held following a connection loss (when there will
+// be no reconnect)
+func Test_Close_ConnectionLost(t *testing.T) {
+	before := runtime.NumGoroutine()
+	b := newFakeBroker()
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetCleanSession(false).
+		SetAutoReconnect(false).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	b.noPuback.Store(true)
+	tok := c.Publish("out", 1, false, "x")
+	nextPacket[*packets.PublishPacket](t, b)
+	b.dropConnection()
+	for i := 0; c.IsConnected() || c.status.ConnectionStatus() != disconnected; i++ {
+		if i > 100 {
+			t.Fatal("connection loss not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if !tok.WaitTimeout(time.Second) || tok.Error() == nil {
+		t.Errorf("expected publish token to fail on Close")
+	}
+	if n := idsInUse(c); n != 0 {
+		t.Errorf("%d message IDs in use after Close", n)
+	}
+	checkGoroutines(t, before)
+}
@@ -0,0 +1,120 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_DeadLetter(t *testing.T) {
+	b := newFakeBroker()
+	store := NewMemoryStore()
+	dead := make(chan *DeadLetter, 10)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetDeadLetterHandler(func(_ Client, dl *DeadLetter) { dead <- dl }).
+		SetDeadLetterTopic("dead", 0).
+		SetDeadLetterStore(store).
+		SetDeadLetterAck(true).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	c.AddRoute("panic/#", func(Client, Message) { panic("boom") })
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(10)
+
+	check := func(topic string, id uint16, reason DeadLetterReason) {
+		t.Helper()
+		if err := b.publish(topic, 1, id, "payload"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case dl := <-dead:
+			if dl.Topic != topic || dl.MessageID != id || dl.Reason != reason || string(dl.Payload) != "payload" {
+				t.Fatalf("unexpected dead letter %+v", dl)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message not dead-lettered")
+		}
+		// The dead letter is published on another goroutine so may be received before or after the PUBACK
+		for i := 0; i < 2; i++ {
+			switch p := nextPacket[packets.ControlPacket](t, b).(type) {
+			case *packets.PublishPacket:
+				var dl DeadLetter
+				if err := json.Unmarshal(p.Payload, &dl); p.TopicName != "dead" || err != nil || dl.Topic != topic || dl.Reason != reason {
+					t.Fatalf("unexpected dead letter publish %s %s (%v)", p.TopicName, p.Payload, err)
+				}
+			case *packets.PubackPacket:
+				if p.MessageID != id {
+					t.Fatalf("expected PUBACK %d, got %d", id, p.MessageID)
+				}
+			default:
+				t.Fatalf("unexpected packet %s", p)
+			}
+		}
+	}
+	check("nowhere", 1, DeadLetterUnroutable)
+	check("panic/x", 2, DeadLetterHandlerPanic)
+
+	dls, err := LoadDeadLetters(store)
+	if err != nil || len(dls) != 2 {
+		t.Fatalf("expected 2 stored dead letters, got %d (%v)", len(dls), err)
+	}
+	if dls[0].Reason != DeadLetterUnroutable || dls[1].Reason != DeadLetterHandlerPanic || dls[1].Error != "boom" {
+		t.Errorf("unexpected stored dead letters %+v %+v", dls[0], dls[1])
+	}
+	store.Del(dls[0].Key)
+	if dls, _ = LoadDeadLetters(store); len(dls) != 1 {
+		t.Errorf("dead letter not deleted")
+	}
+	if s := c.Stats(); s.DeadLetters != 2 {
+		t.Errorf("expected 2 dead letters, got %d", s.DeadLetters)
+	}
+}
+
+// Test_DeadLetterPublishNonBlocking checks that publishing a dead letter does not block the caller (which may be
+// the goroutine processing incoming messages) when the outgoing queue is full
+func Test_DeadLetterPublishNonBlocking(t *testing.T) {
+	ops := NewClientOptions().
+		SetDeadLetterTopic("dead", 0).
+		SetWriteTimeout(5 * time.Second)
+	c := NewClient(ops).(*client)
+	c.obound = make(chan *PacketAndToken) // nothing is reading from this
+	c.status.forceConnectionStatus(connected)
+
+	done := make(chan struct{})
+	go func() {
+		c.deadLetter(&message{topic: "a", payload: []byte("x")}, DeadLetterUnroutable, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deadLetter blocked whilst publishing")
+	}
+	select {
+	case pt := <-c.obound:
+		if p := pt.p.(*packets.PublishPacket); p.TopicName != "dead" {
+			t.Errorf("unexpected publish to %s", p.TopicName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dead letter not published")
+	}
+	c.routines.Wait()
+}
@@ -0,0 +1,161 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_FileDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	s, err := NewFileDedupStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add("client/1/ab", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add("with space\n", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add("expired", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = NewFileDedupStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for key, exp := range map[string]bool{"client/1/ab": true, "with space\n": true, "expired": false, "other": false} {
+		if got, err := s.Contains(key); got != exp || err != nil {
+			t.Errorf("Contains(%q) = %t %v", key, got, err)
+		}
+	}
+	if len(s.entries) != 2 {
+		t.Errorf("expired entry should have been removed when the store was opened")
+	}
+}
+
+func Test_ExactlyOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	run := func(msgs ...*packets.PublishPacket) (calls int) {
+		store, err := NewFileDedupStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		b := newFakeBroker()
+		called := make(chan struct{}, 10)
+		ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+			SetClientID("dedup").
+			SetProtocolVersion(4).
+			SetDedupStore(store, time.Hour).
+			SetCustomOpenConnectionFn(b.open)
+		c := NewClient(ops).(*client)
+		c.AddRouteWithMiddleware("a", func(Client, Message) { called <- struct{}{} }, ExactlyOnce)
+		c.AddRoute("end", func(Client, Message) {})
+		if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+			t.Fatalf("connect failed: %v", tok.Error())
+		}
+		defer c.Disconnect(10)
+		for _, p := range msgs {
+			if err := b.write(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// send a QoS 1 message to a different topic and wait for its PUBACK (all earlier messages will then have
+		// been processed as OrderMatters is set)
+		if err := b.publish("end", 1, 100, ""); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID == 100 {
+				break
+			}
+		}
+		if s := c.Stats(); s.DuplicatesDropped != uint64(len(msgs)-len(called)) {
+			t.Errorf("expected %d duplicates, got %d", len(msgs)-len(called), s.DuplicatesDropped)
+		}
+		return len(called)
+	}
+	pub := func(qos byte, id uint16, dup bool, payload string) *packets.PublishPacket {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName, p.Qos, p.MessageID, p.Dup, p.Payload = "a", qos, id, dup, []byte(payload)
+		return p
+	}
+
+	// The final message reuses packet ID 1 (without DUP) so is not a redelivery
+	if n := run(pub(1, 1, false, "x"), pub(1, 1, true, "x"), pub(1, 2, false, "x"), pub(0, 0, false, "x"), pub(0, 0, false, "x"), pub(1, 1, false, "x")); n != 5 {
+		t.Fatalf("expected handler to be called 5 times, got %d", n)
+	}
+	// Simulate a restart (the broker redelivers message 2)
+	if n := run(pub(1, 2, true, "x"), pub(1, 1, false, "y")); n != 1 {
+		t.Fatalf("expected handler to be called once after restart, got %d", n)
+	}
+}
+
+// Test_ExactlyOnce_InFlight checks that a redelivery received whilst the original is being processed is not
+// acknowledged (so the message is not lost if the original is not processed successfully)
+func Test_ExactlyOnce_InFlight(t *testing.T) {
+	b := newFakeBroker()
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetOrderMatters(false).
+		SetAutoAckDisabled(true). // ACKs are sent in the order messages were received
+		SetDedupStore(NewMemoryDedupStore(), 0).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	c.AddRouteWithMiddleware("a", func(_ Client, m Message) {
+		started <- struct{}{}
+		<-release
+		Nack(m)
+	}, ExactlyOnce)
+	c.AddRoute("end", func(_ Client, m Message) { m.Ack() })
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(10)
+
+	if err := b.publish("a", 1, 1, "x"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	dup := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	dup.TopicName, dup.Qos, dup.MessageID, dup.Dup, dup.Payload = "a", 1, 1, true, []byte("x")
+	if err := b.write(dup); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; c.Stats().DuplicatesDropped != 1; i++ {
+		if i > 100 {
+			t.Fatalf("duplicate not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := b.publish("end", 1, 2, ""); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID != 2 {
+		t.Fatalf("expected only PUBACK 2, got PUBACK %d", pa.MessageID)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_EchoTracker(t *testing.T) {
+	e := newEchoTracker(time.Hour)
+	e.record("a/b", []byte("x"))
+	e.record("a/b", []byte("x"))
+	if e.consume("a/b", []byte("y")) || e.consume("a/c", []byte("x")) {
+		t.Fatalf("message with different topic or payload identified as echo")
+	}
+	if !e.consume("a/b", []byte("x")) || !e.consume("a/b", []byte("x")) {
+		t.Fatalf("echoes not identified")
+	}
+	if e.consume("a/b", []byte("x")) {
+		t.Fatalf("each publish should only suppress one echo")
+	}
+
+	e = newEchoTracker(time.Millisecond)
+	e.record("a/b", []byte("x"))
+	time.Sleep(5 * time.Millisecond)
+	if e.consume("a/b", []byte("x")) {
+		t.Fatalf("expired publish should not suppress message")
+	}
+	if e.suppressed.Load() != 0 || len(e.pending) != 0 {
+		t.Fatalf("unexpected state %d %d", e.suppressed.Load(), len(e.pending))
+	}
+}
+
+func Test_LocalDelivery(t *testing.T) {
+	b := newFakeBroker()
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetLocalDelivery(true).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	r := c.OptionsReader()
+	if w := r.EchoSuppressionWindow(); w != 0 || c.echoes == nil || c.echoes.window != defaultEchoWindow {
+		t.Fatalf("local delivery should enable echo suppression with default window (option %v)", w)
+	}
+
+	received := make(chan string, 10)
+	c.AddRoute("a/+", func(_ Client, m Message) { received <- string(m.Payload()) })
+
+	// Delivered locally even though not connected
+	if tok := c.Publish("a/b", 1, false, "offline"); tok.Error() != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", tok.Error())
+	}
+	select {
+	case p := <-received:
+		if p != "offline" {
+			t.Fatalf("unexpected payload %s", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not delivered locally")
+	}
+
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(10)
+	if tok := c.Publish("a/b", 1, false, "online"); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("publish failed: %v", tok.Error())
+	}
+	if p := <-received; p != "online" {
+		t.Fatalf("unexpected payload %s", p)
+	}
+
+	// The broker echoes the message back; this should be acknowledged but not passed to the handler
+	if err := b.publish("a/b", 1, 7, "online"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID == 7 {
+			break
+		}
+	}
+	if err := b.publish("a/b", 0, 0, "other"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-received:
+		if p != "other" {
+			t.Fatalf("echo was not suppressed (received %s)", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message from broker not delivered")
+	}
+	if s := c.Stats(); s.EchoesSuppressed != 1 {
+		t.Errorf("expected 1 echo suppressed, got %d", s.EchoesSuppressed)
+	}
+}
+
+// Test_LocalDelivery_Reentrant checks that locally delivered messages are handled off the publishing goroutine so
+// that a handler may publish (without recursing) and a blocked handler does not hold up Publish
+func Test_LocalDelivery_Reentrant(t *testing.T) {
+	before := runtime.NumGoroutine()
+	c := NewClient(NewClientOptions().SetLocalDelivery(true)).(*client)
+	received := make(chan string, 10)
+	release := make(chan struct{})
+	depth := 0 // only accessed by handlers (which are never run concurrently)
+	c.AddRoute("a", func(cl Client, m Message) {
+		depth++
+		defer func() { depth-- }()
+		if depth > 1 {
+			t.Errorf("handler called recursively")
+		}
+		received <- string(m.Payload())
+		if p := string(m.Payload()); len(p) < 3 {
+			cl.Publish("a", 0, false, p+"x")
+		}
+	})
+	c.AddRoute("b", func(Client, Message) { <-release })
+
+	done := make(chan struct{})
+	go func() {
+		c.Publish("b", 0, false, "block")
+		c.Publish("a", 0, false, "x")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Publish blocked by handler")
+	}
+	select {
+	case p := <-received:
+		t.Fatalf("message %s delivered out of order", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	for _, want := range []string{"x", "xx", "xxx"} {
+		select {
+		case p := <-received:
+			if p != want {
+				t.Fatalf("expected %s, got %s", want, p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not delivered", want)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	checkGoroutines(t, before)
+}
+
+func Test_EchoTracker_Forget(t *testing.T) {
+	e := newEchoTracker(time.Minute)
+	e.record("a", []byte("x"))
+	e.record("a", []byte("x"))
+	e.forget("a", []byte("x"))
+	if !e.consume("a", []byte("x")) {
+		t.Fatalf("remaining publish should suppress message")
+	}
+	if e.consume("a", []byte("x")) || len(e.pending) != 0 {
+		t.Fatalf("forgotten publish should not suppress message")
+	}
+	e.record("b", []byte("x"))
+	e.forget("b", []byte("x"))
+	if len(e.pending) != 0 {
+		t.Fatalf("expected no pending publishes, got %d", len(e.pending))
+	}
+}
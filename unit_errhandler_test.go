@@ -0,0 +1,88 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_HandleErrors(t *testing.T) {
+	b := newFakeBroker()
+	hookCalls := make(chan int, 10)
+	dead := make(chan *DeadLetter, 1)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetHandlerRetry(2, time.Millisecond, 2*time.Millisecond).
+		SetHandlerErrorPolicy(HandlerErrorDeadLetter).
+		SetHandlerErrorHandler(func(_ Client, _ Message, _ error, attempt int) { hookCalls <- attempt }).
+		SetDeadLetterHandler(func(_ Client, dl *DeadLetter) { dead <- dl }).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+
+	var calls atomic.Int32
+	errFail := errors.New("fail")
+	c.AddRoute("flaky", HandleErrors(func(Client, Message) error { // succeeds on the second attempt
+		if calls.Add(1) == 1 {
+			return errFail
+		}
+		return nil
+	}))
+	c.AddRoute("broken", HandleErrors(func(Client, Message) error { return errFail }))
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(10)
+
+	if err := b.publish("flaky", 1, 1, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID != 1 {
+		t.Fatalf("expected PUBACK 1, got %d", pa.MessageID)
+	}
+	if a := <-hookCalls; a != 1 || calls.Load() != 2 {
+		t.Fatalf("unexpected attempt %d (calls %d)", a, calls.Load())
+	}
+
+	// Fails on all three attempts so is dead-lettered (and not acknowledged as DeadLetterAck is not set)
+	if err := b.publish("broken", 1, 2, "x"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case dl := <-dead:
+		if dl.Reason != DeadLetterHandlerError || dl.Error != "fail" || dl.MessageID != 2 {
+			t.Fatalf("unexpected dead letter %+v", dl)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not dead-lettered")
+	}
+	for i := 1; i <= 3; i++ {
+		if a := <-hookCalls; a != i {
+			t.Fatalf("expected attempt %d, got %d", i, a)
+		}
+	}
+	if err := b.publish("flaky", 1, 3, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if pa := nextPacket[*packets.PubackPacket](t, b); pa.MessageID != 3 {
+		t.Fatalf("expected PUBACK 3 (message 2 should not be acknowledged), got %d", pa.MessageID)
+	}
+	if s := c.Stats(); s.HandlerErrors != 4 || s.HandlerRetries != 3 {
+		t.Errorf("unexpected stats %d errors, %d retries", s.HandlerErrors, s.HandlerRetries)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_ConnackError(t *testing.T) {
+	tests := map[byte]error{
+		packets.ErrRefusedBadProtocolVersion:    ErrConnRefusedBadProtocolVersion,
+		packets.ErrRefusedIDRejected:            ErrConnRefusedIDRejected,
+		packets.ErrRefusedServerUnavailable:     ErrConnRefusedServerUnavailable,
+		packets.ErrRefusedBadUsernameOrPassword: ErrConnRefusedBadUsernameOrPassword,
+		packets.ErrRefusedNotAuthorised:         ErrConnRefusedNotAuthorised,
+	}
+	for rc, exp := range tests {
+		var err error = &ConnackError{ReturnCode: rc}
+		if !errors.Is(err, exp) {
+			t.Errorf("rc %d: expected errors.Is(%v)", rc, exp)
+		}
+		if err.Error() != exp.Error() {
+			t.Errorf("rc %d: expected message %q, got %q", rc, exp.Error(), err.Error())
+		}
+		if err = connackError(rc); err != exp { // must remain comparable with ==
+			t.Errorf("rc %d: expected %v, got %#v", rc, exp, err)
+		}
+	}
+	if err := (&ConnackError{ReturnCode: 42}); err.Error() == "" || err.Unwrap() != nil {
+		t.Errorf("unknown return code should have message and no wrapped error")
+	}
+	var ce *ConnackError
+	if err := connackError(42); !errors.As(err, &ce) || ce.ReturnCode != 42 {
+		t.Errorf("expected ConnackError for unknown return code, got %v", err)
+	}
+}
+
+func Test_commsError(t *testing.T) {
+	err := commsError(os.ErrDeadlineExceeded, true)
+	var ne *NetworkError
+	if !errors.As(err, &ne) || !errors.Is(err, ErrNetworkError) || !errors.Is(err, ErrWriteTimeout) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("write timeout not wrapped as expected: %v", err)
+	}
+	if err = commsError(os.ErrDeadlineExceeded, false); errors.Is(err, ErrWriteTimeout) {
+		t.Errorf("read errors should not be reported as ErrWriteTimeout")
+	}
+	if commsError(err, false) != err {
+		t.Errorf("NetworkError should not be wrapped twice")
+	}
+	if _, err = packets.ReadPacket(&fixedReader{b: []byte{0xF0, 0x00}}); !errors.Is(commsError(err, false), ErrProtocolViolation) {
+		t.Errorf("expected protocol violation, got %v", err)
+	}
+}
+
+// fixedReader returns the bytes in b and then an error
+type fixedReader struct{ b []byte }
+
+func (r *fixedReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, os.ErrClosed
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func Test_ConnectErrors(t *testing.T) {
+	connects := make(chan *packets.ConnectPacket, 10)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetCustomOpenConnectionFn(func(uri *url.URL, options ClientOptions) (net.Conn, error) {
+			return fakeBrokerConn(packets.ErrRefusedNotAuthorised, connects), nil
+		})
+	c := NewClient(ops)
+	tok := c.Connect()
+	if !tok.WaitTimeout(time.Second) {
+		t.Fatal("connect did not complete")
+	}
+	if tok.Error() != ErrConnRefusedNotAuthorised {
+		t.Errorf("expected ErrConnRefusedNotAuthorised, got %v", tok.Error())
+	}
+
+	cause := errors.New("dial failed")
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL, options ClientOptions) (net.Conn, error) {
+		return nil, cause
+	})
+	c = NewClient(ops)
+	tok = c.Connect()
+	if !tok.WaitTimeout(time.Second) {
+		t.Fatal("connect did not complete")
+	}
+	if err := tok.Error(); !errors.Is(err, ErrNetworkError) || !errors.Is(err, cause) || err.Error() != "network Error : dial failed" {
+		t.Errorf("expected NetworkError wrapping cause, got %v", err)
+	}
+
+	broker, _ := url.Parse("foo://127.0.0.1:1883")
+	if _, err := openConnection(broker, nil, time.Second, nil, nil, &net.Dialer{}, nil); !errors.Is(err, ErrUnknownProtocol) {
+		t.Errorf("expected ErrUnknownProtocol, got %v", err)
+	}
+}
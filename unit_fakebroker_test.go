@@ -0,0 +1,154 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeBroker is a minimal broker, used by the unit tests, that communicates with the client over a net.Pipe. Use
+// fakeBroker.open as the CustomOpenConnectionFn.
+type fakeBroker struct {
+	rc       byte                          // Return code sent in CONNACK
+	connects chan<- *packets.ConnectPacket // CONNECT packets are sent here (if not nil)
+	received chan packets.ControlPacket    // All other packets received (dropped if the channel is full)
+	mu       sync.Mutex                    // protects conn and writes to it
+	conn     net.Conn                      // server end of the current connection
+	noPuback atomic.Bool                   // if set, QoS 1 PUBLISH packets are not acknowledged
+}
+
+// newFakeBroker creates a fakeBroker that will accept connections
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{rc: packets.Accepted, received: make(chan packets.ControlPacket, 100)}
+}
+
+// fakeBrokerConn returns a connection to a minimal broker that responds to CONNECT with a CONNACK containing the
+// return code from rc. The CONNECT packets received are passed to connects.
+func fakeBrokerConn(rc byte, connects chan<- *packets.ConnectPacket) net.Conn {
+	b := newFakeBroker()
+	b.rc, b.connects = rc, connects
+	conn, _ := b.open(nil, ClientOptions{})
+	return conn
+}
+
+// open establishes a new connection to the broker (matches OpenConnectionFunc)
+func (b *fakeBroker) open(_ *url.URL, _ ClientOptions) (net.Conn, error) {
+	cConn, sConn := net.Pipe()
+	b.mu.Lock()
+	b.conn = sConn
+	b.mu.Unlock()
+	go b.serve(sConn)
+	return cConn, nil
+}
+
+// serve handles packets received from the client
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			if b.connects != nil {
+				b.connects <- p
+			}
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ReturnCode = b.rc
+			if b.writeTo(conn, ca) != nil || b.rc != packets.Accepted {
+				return
+			}
+			continue
+		case *packets.SubscribePacket:
+			sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			sa.MessageID, sa.ReturnCodes = p.MessageID, p.Qoss
+			reply = sa
+		case *packets.UnsubscribePacket:
+			ua := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ua.MessageID = p.MessageID
+			reply = ua
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				if b.noPuback.Load() {
+					break
+				}
+				pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				pa.MessageID = p.MessageID
+				reply = pa
+			case 2:
+				pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				pr.MessageID = p.MessageID
+				reply = pr
+			}
+		case *packets.PubrelPacket:
+			pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pc.MessageID = p.MessageID
+			reply = pc
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		}
+		select {
+		case b.received <- cp:
+		default:
+		}
+		if _, ok := cp.(*packets.DisconnectPacket); ok {
+			return
+		}
+		if reply != nil && b.writeTo(conn, reply) != nil {
+			return
+		}
+	}
+}
+
+// writeTo writes p to conn
+func (b *fakeBroker) writeTo(conn net.Conn, p packets.ControlPacket) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return p.Write(conn)
+}
+
+// write sends p to the client over the current connection
+func (b *fakeBroker) write(p packets.ControlPacket) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return errors.New("not connected")
+	}
+	return p.Write(b.conn)
+}
+
+// publish sends a PUBLISH to the client
+func (b *fakeBroker) publish(topic string, qos byte, id uint16, payload string) error {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName, pub.Qos, pub.MessageID, pub.Payload = topic, qos, id, []byte(payload)
+	return b.write(pub)
+}
+
+// dropConnection closes the current connection (simulating a network failure)
+func (b *fakeBroker) dropConnection() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		_ = b.conn.Close()
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_TopicRewriters(t *testing.T) {
+	p := NewPrefixRewriter("tenants/42")
+	tests := map[string]string{
+		"a/b":             "tenants/42/a/b",
+		"#":               "tenants/42/#",
+		"$share/g/a/+":    "$share/g/tenants/42/a/+",
+		"$SYS/#":          "",
+		"$share/g/$SYS/#": "",
+	}
+	for app, exp := range tests {
+		got, err := p.ToBroker(app)
+		if exp == "" {
+			if !errors.Is(err, ErrOutsideNamespace) {
+				t.Errorf("%s: expected ErrOutsideNamespace, got %q %v", app, got, err)
+			}
+			continue
+		}
+		if got != exp || err != nil {
+			t.Errorf("%s: expected %s, got %s %v", app, exp, got, err)
+		}
+	}
+	if name, ok := p.FromBroker("tenants/42/a/b"); !ok || name != "a/b" {
+		t.Errorf("unexpected FromBroker result %s %t", name, ok)
+	}
+	if _, ok := p.FromBroker("tenants/43/a/b"); ok {
+		t.Errorf("topic outside namespace should not be converted")
+	}
+
+	m := NewMapRewriter(map[string]string{"status": "devices/status/42"}, p)
+	if b, _ := m.ToBroker("status"); b != "devices/status/42" {
+		t.Errorf("unexpected mapping %s", b)
+	}
+	if b, _ := m.ToBroker("other"); b != "tenants/42/other" {
+		t.Errorf("unexpected fallback %s", b)
+	}
+	if a, ok := m.FromBroker("devices/status/42"); !ok || a != "status" {
+		t.Errorf("unexpected reverse mapping %s", a)
+	}
+	if _, err := NewMapRewriter(nil, nil).ToBroker("x"); !errors.Is(err, ErrOutsideNamespace) {
+		t.Errorf("expected unmapped topic to be rejected, got %v", err)
+	}
+}
+
+func Test_NamespacedClient(t *testing.T) {
+	b := newFakeBroker()
+	connects := make(chan *packets.ConnectPacket, 1)
+	b.connects = connects
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetWill("status", "offline", 1, true).
+		SetRouteParams(true).
+		SetCustomOpenConnectionFn(b.open)
+	c, err := NewNamespacedClient(ops, NewPrefixRewriter("tenants/42/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(0)
+	if cp := <-connects; cp.WillTopic != "tenants/42/status" {
+		t.Errorf("will topic not rewritten: %s", cp.WillTopic)
+	}
+
+	type delivery struct {
+		client Client
+		topic  string
+		id     string
+	}
+	received := make(chan delivery, 1)
+	if tok := c.Subscribe("device/{id}/#", 1, func(cl Client, m Message) {
+		received <- delivery{client: cl, topic: m.Topic(), id: TopicParam(m, "id")}
+	}); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	if sub := nextPacket[*packets.SubscribePacket](t, b); sub.Topics[0] != "tenants/42/device/+/#" {
+		t.Errorf("SUBSCRIBE not rewritten: %v", sub.Topics)
+	}
+
+	_ = b.publish("tenants/42/device/7/temp", 1, 1, "21")
+	select {
+	case d := <-received:
+		if d.topic != "device/7/temp" || d.id != "7" || d.client != c {
+			t.Errorf("unexpected delivery %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	if tok := c.Publish("device/7/cmd", 1, false, "x"); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("publish failed: %v", tok.Error())
+	}
+	if pub := nextPacket[*packets.PublishPacket](t, b); pub.TopicName != "tenants/42/device/7/cmd" {
+		t.Errorf("PUBLISH not rewritten: %s", pub.TopicName)
+	}
+	if tok := c.Publish("$SYS/x", 0, false, "x"); !errors.Is(tok.Error(), ErrOutsideNamespace) {
+		t.Errorf("expected ErrOutsideNamespace, got %v", tok.Error())
+	}
+	if s, tok := c.(ChanSubscriber).SubscribeChan("$SYS/#", 0, 1, OverflowBlock); !errors.Is(tok.Error(), ErrOutsideNamespace) {
+		t.Errorf("expected ErrOutsideNamespace, got %v", tok.Error())
+	} else if _, ok := <-s.C(); ok {
+		t.Errorf("channel should be closed")
+	}
+
+	if tok := c.Unsubscribe("device/{id}/#"); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("unsubscribe failed: %v", tok.Error())
+	}
+	if unsub := nextPacket[*packets.UnsubscribePacket](t, b); unsub.Topics[0] != "tenants/42/device/+/#" {
+		t.Errorf("UNSUBSCRIBE not rewritten: %v", unsub.Topics)
+	}
+}
+
+func Test_NamespacedClient_Handlers(t *testing.T) {
+	b := newFakeBroker()
+	connected := make(chan Client, 1)
+	lost := make(chan Client, 1)
+	received := make(chan Message, 2)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetAutoReconnect(false).
+		SetAutoAckDisabled(true).
+		SetOnConnectHandler(func(c Client) { connected <- c }).
+		SetConnectionLostHandler(func(c Client, _ error) { lost <- c }).
+		SetDefaultPublishHandler(func(_ Client, m Message) {
+			received <- m
+			m.Ack()
+		}).
+		SetCustomOpenConnectionFn(b.open)
+	c, err := NewNamespacedClient(ops, NewPrefixRewriter("tenants/42/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	if cl := <-connected; cl != c {
+		t.Errorf("OnConnect passed %T, expected the namespaced client", cl)
+	}
+
+	// The message outside the namespace is acknowledged but not passed to the handler
+	_ = b.publish("tenants/43/a", 1, 1, "x")
+	_ = b.publish("tenants/42/a", 1, 2, "y")
+	if ack := nextPacket[*packets.PubackPacket](t, b); ack.MessageID != 1 {
+		t.Errorf("expected PUBACK for message 1, got %d", ack.MessageID)
+	}
+	select {
+	case m := <-received:
+		if m.Topic() != "a" || string(m.Payload()) != "y" {
+			t.Errorf("unexpected message %s %s", m.Topic(), m.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	if ack := nextPacket[*packets.PubackPacket](t, b); ack.MessageID != 2 {
+		t.Errorf("expected PUBACK for message 2, got %d", ack.MessageID)
+	}
+	select {
+	case m := <-received:
+		t.Errorf("message outside namespace delivered: %s", m.Topic())
+	default:
+	}
+	if n := c.(StatsReporter).Stats().OutsideNamespace; n != 1 {
+		t.Errorf("expected 1 message outside namespace, got %d", n)
+	}
+
+	b.dropConnection()
+	select {
+	case cl := <-lost:
+		if cl != c {
+			t.Errorf("OnConnectionLost passed %T, expected the namespaced client", cl)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection lost handler not called")
+	}
+	_ = c.(io.Closer).Close()
+}
@@ -0,0 +1,145 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func testPolicy() *TopicPolicy {
+	return &TopicPolicy{
+		Publish: TopicACL{
+			Allow: []TopicRule{
+				{Filter: "tenants/a/#", LimitQos: true, MaxQos: 1, DenyRetain: true},
+				{Filter: "tenants/a/state/+"},
+			},
+			Deny: []string{"tenants/a/admin/#"},
+		},
+		Subscribe: TopicACL{
+			Allow: []TopicRule{{Filter: "tenants/a/#", LimitQos: true, MaxQos: 1}},
+			Deny:  []string{"tenants/a/secret"},
+		},
+	}
+}
+
+func Test_TopicPolicy(t *testing.T) {
+	p := testPolicy()
+	pubs := []struct {
+		topic    string
+		qos      byte
+		retained bool
+		allowed  bool
+	}{
+		{"tenants/a/x", 1, false, true},
+		{"tenants/a/x", 2, false, false},
+		{"tenants/a/x", 0, true, false},
+		{"tenants/a/state/1", 2, true, true},
+		{"tenants/a/admin/reset", 0, false, false},
+		{"tenants/b/x", 0, false, false},
+	}
+	for _, test := range pubs {
+		if err := p.checkPublish(test.topic, test.qos, test.retained); (err == nil) != test.allowed {
+			t.Errorf("publish %s qos %d retained %t: unexpected result %v", test.topic, test.qos, test.retained, err)
+		}
+	}
+
+	// A rule with only a filter permits any QoS and retained messages; MaxQos is only applied with LimitQos
+	zero := &TopicPolicy{
+		Publish:   TopicACL{Allow: []TopicRule{{Filter: "a/#"}, {Filter: "b/#", LimitQos: true}}},
+		Subscribe: TopicACL{Allow: []TopicRule{{Filter: "a/#"}}},
+	}
+	if err := zero.checkPublish("a/x", 2, true); err != nil {
+		t.Errorf("zero value rule should permit QoS 2 retained messages: %v", err)
+	}
+	if err := zero.checkSubscribe("subscribe", "a/x", 2); err != nil {
+		t.Errorf("zero value rule should permit QoS 2 subscriptions: %v", err)
+	}
+	if err := zero.checkPublish("b/x", 1, false); err == nil {
+		t.Errorf("LimitQos rule should only permit QoS 0")
+	}
+
+	subs := []struct {
+		filter  string
+		qos     byte
+		allowed bool
+	}{
+		{"tenants/a/+", 1, false}, // overlaps tenants/a/secret
+		{"tenants/a/x/#", 1, true},
+		{"$share/g/tenants/a/x/#", 1, true},
+		{"tenants/a/x/#", 2, false},
+		{"#", 0, false},
+		{"tenants/+/x", 0, false},
+	}
+	for _, test := range subs {
+		err := p.checkSubscribe("subscribe", test.filter, test.qos)
+		if (err == nil) != test.allowed {
+			t.Errorf("subscribe %s qos %d: unexpected result %v", test.filter, test.qos, err)
+		}
+		var pe *PolicyError
+		if err != nil && (!errors.Is(err, ErrPolicyDenied) || !errors.As(err, &pe) || pe.Topic != test.filter) {
+			t.Errorf("expected PolicyError, got %v", err)
+		}
+	}
+
+	if err := (&TopicPolicy{}).checkPublish("any", 2, true); err != nil {
+		t.Errorf("empty policy should permit everything, got %v", err)
+	}
+}
+
+func Test_TopicPolicy_Client(t *testing.T) {
+	b := newFakeBroker()
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetTopicPolicy(testPolicy()).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(0)
+
+	denied := []Token{
+		c.Publish("tenants/b/x", 0, false, "x"),
+		c.Subscribe("#", 0, nil),
+		c.SubscribeMultiple(map[string]byte{"tenants/a/x": 0, "tenants/b/x": 0}, nil),
+	}
+	for i, tok := range denied {
+		if !tok.WaitTimeout(time.Second) || !errors.Is(tok.Error(), ErrPolicyDenied) {
+			t.Errorf("%d: expected policy denial, got %v", i, tok.Error())
+		}
+	}
+	c.AddRoute("tenants/b/#", func(Client, Message) {})
+	if n := c.msgRouter.routes.Len(); n != 0 {
+		t.Errorf("denied route should not have been added (%d routes)", n)
+	}
+	if n := c.Stats().PolicyDenials; n != 4 {
+		t.Errorf("expected 4 denials, got %d", n)
+	}
+
+	if tok := c.Publish("tenants/a/x", 1, false, "x"); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("publish failed: %v", tok.Error())
+	}
+	select { // nothing denied should have reached the broker
+	case p := <-b.received:
+		if pub, ok := p.(*packets.PublishPacket); !ok || pub.TopicName != "tenants/a/x" {
+			t.Errorf("unexpected packet %v", p)
+		}
+	case <-time.After(time.Second):
+		t.Error("publish not received")
+	}
+}
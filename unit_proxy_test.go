@@ -0,0 +1,164 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startEchoServer starts a TCP server that echos back anything received
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// startConnectProxy starts a minimal HTTP CONNECT proxy; the Proxy-Authorization header received is sent to authHdr
+func startConnectProxy(t *testing.T, authHdr chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				authHdr <- req.Header.Get("Proxy-Authorization")
+				if req.Method != http.MethodConnect {
+					_, _ = c.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer target.Close()
+				_, _ = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go func() { _, _ = io.Copy(target, c) }()
+				_, _ = io.Copy(c, target)
+			}()
+		}
+	}()
+	return l
+}
+
+func Test_openConnection_HTTPConnectProxy(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	authHdr := make(chan string, 1)
+	prx := startConnectProxy(t, authHdr)
+	defer prx.Close()
+
+	proxyURL, _ := url.Parse("http://user:pass@" + prx.Addr().String())
+	broker, _ := url.Parse("tcp://" + echo.Addr().String())
+	conn, err := openConnection(broker, nil, time.Second, nil, nil, &net.Dialer{Timeout: time.Second}, ProxyURL(proxyURL))
+	if err != nil {
+		t.Fatalf("openConnection via proxy failed: %s", err)
+	}
+	defer conn.Close()
+
+	if got := <-authHdr; got != "Basic dXNlcjpwYXNz" {
+		t.Errorf("unexpected Proxy-Authorization header %q", got)
+	}
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("expected ping, got %q", buf)
+	}
+}
+
+func Test_openConnection_ProxyRejected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = http.ReadRequest(bufio.NewReader(c))
+		_, _ = c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+	}()
+
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	broker, _ := url.Parse("tcp://127.0.0.1:1883")
+	if _, err = openConnection(broker, nil, time.Second, nil, nil, &net.Dialer{Timeout: time.Second}, ProxyURL(proxyURL)); err == nil {
+		t.Fatalf("expected error when proxy rejects CONNECT")
+	}
+}
+
+func Test_ProxyFromEnvironment(t *testing.T) {
+	t.Setenv("MQTT_PROXY", "http://proxy.example.com:3128")
+	t.Setenv("NO_PROXY", "internal.example.com")
+
+	check := func(broker string, exp string) {
+		u, _ := url.Parse(broker)
+		p, err := ProxyFromEnvironment(&http.Request{URL: u})
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", broker, err)
+		}
+		got := ""
+		if p != nil {
+			got = p.String()
+		}
+		if got != exp {
+			t.Errorf("proxy for %s: expected %q, got %q", broker, exp, got)
+		}
+	}
+	check("tcp://broker.example.com:1883", "http://proxy.example.com:3128")
+	check("ssl://broker.example.com:8883", "http://proxy.example.com:3128")
+	check("tcp://internal.example.com:1883", "")
+
+	t.Setenv("HTTPS_PROXY", "http://webproxy.example.com:8080")
+	check("wss://broker.example.com:443", "http://webproxy.example.com:8080")
+	check("tcp://broker.example.com:1883", "http://proxy.example.com:3128")
+}
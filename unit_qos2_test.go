@@ -0,0 +1,228 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_Qos2DeliverOnPubrel(t *testing.T) {
+	store := NewMemoryStore()
+	received := make(chan string, 10)
+	connect := func() (*fakeBroker, Client) {
+		b := newFakeBroker()
+		ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+			SetClientID("qos2").
+			SetProtocolVersion(4).
+			SetCleanSession(false).
+			SetStore(store).
+			SetQos2DeliverOnPubrel(true).
+			SetDefaultPublishHandler(func(_ Client, m Message) { received <- string(m.Payload()) }).
+			SetCustomOpenConnectionFn(b.open)
+		c := NewClient(ops)
+		if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+			t.Fatalf("connect failed: %v", tok.Error())
+		}
+		return b, c
+	}
+	pubrel := func(b *fakeBroker, id uint16) {
+		t.Helper()
+		pr := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pr.MessageID = id
+		if err := b.write(pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notReceived := func() {
+		t.Helper()
+		select {
+		case p := <-received:
+			t.Fatalf("message %s delivered before PUBREL", p)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	b, c := connect()
+	if err := b.publish("a", 2, 1, "one"); err != nil {
+		t.Fatal(err)
+	}
+	if pr := nextPacket[*packets.PubrecPacket](t, b); pr.MessageID != 1 {
+		t.Fatalf("expected PUBREC 1, got %d", pr.MessageID)
+	}
+	notReceived()
+
+	// A resent PUBLISH is acknowledged but not delivered
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName, pub.Qos, pub.MessageID, pub.Dup, pub.Payload = "a", 2, 1, true, []byte("one")
+	if err := b.write(pub); err != nil {
+		t.Fatal(err)
+	}
+	if pr := nextPacket[*packets.PubrecPacket](t, b); pr.MessageID != 1 {
+		t.Fatalf("expected PUBREC 1, got %d", pr.MessageID)
+	}
+	notReceived()
+
+	pubrel(b, 1)
+	if p := <-received; p != "one" {
+		t.Fatalf("unexpected message %s", p)
+	}
+	if pc := nextPacket[*packets.PubcompPacket](t, b); pc.MessageID != 1 {
+		t.Fatalf("expected PUBCOMP 1, got %d", pc.MessageID)
+	}
+	notReceived()
+
+	// A message held when the client disconnects is delivered when PUBREL is received after it restarts
+	if err := b.publish("a", 2, 2, "two"); err != nil {
+		t.Fatal(err)
+	}
+	nextPacket[*packets.PubrecPacket](t, b)
+	c.Disconnect(10)
+
+	b, c = connect()
+	defer c.Disconnect(10)
+	pubrel(b, 2)
+	if p := <-received; p != "two" {
+		t.Fatalf("unexpected message %s", p)
+	}
+	if pc := nextPacket[*packets.PubcompPacket](t, b); pc.MessageID != 2 {
+		t.Fatalf("expected PUBCOMP 2, got %d", pc.MessageID)
+	}
+	if keys := store.All(); len(keys) != 0 {
+		t.Errorf("store should be empty, contains %v", keys)
+	}
+
+	// PUBREL for a message that is not held is completed immediately
+	pubrel(b, 3)
+	if pc := nextPacket[*packets.PubcompPacket](t, b); pc.MessageID != 3 {
+		t.Fatalf("expected PUBCOMP 3, got %d", pc.MessageID)
+	}
+	notReceived()
+}
+
+// Test_Qos2DeliverOnPubrel_ConnectionLost checks that a PUBCOMP held (by OrderedAcks) when the connection is lost,
+// or released after that, is discarded; the messages remain in the store so are delivered again when the broker
+// resends PUBREL
+func Test_Qos2DeliverOnPubrel_ConnectionLost(t *testing.T) {
+	b := newFakeBroker()
+	received := make(chan Message, 10)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetClientID("qos2").
+		SetProtocolVersion(4).
+		SetCleanSession(false).
+		SetAutoReconnect(false).
+		SetQos2DeliverOnPubrel(true).
+		SetAutoAckDisabled(true).
+		SetOrderedAcks(true).
+		SetAckTimeout(100 * time.Millisecond).
+		SetDefaultPublishHandler(func(_ Client, m Message) { received <- m }).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Close()
+	pubrel := func(id uint16) {
+		t.Helper()
+		pr := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pr.MessageID = id
+		if err := b.write(pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var msgs []Message
+	for id := uint16(1); id <= 2; id++ {
+		if err := b.publish("a", 2, id, "x"); err != nil {
+			t.Fatal(err)
+		}
+		nextPacket[*packets.PubrecPacket](t, b)
+		pubrel(id)
+		msgs = append(msgs, <-received)
+	}
+	msgs[1].Ack() // PUBCOMP held waiting for message 1
+	b.dropConnection()
+	for i := 0; c.status.ConnectionStatus() != disconnected; i++ {
+		if i > 100 {
+			t.Fatal("connection loss not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond) // the ack timeout would have released the held PUBCOMP
+	msgs[0].Ack()
+
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("reconnect failed: %v", tok.Error())
+	}
+	for id := uint16(1); id <= 2; id++ {
+		pubrel(id)
+		m := <-received
+		if m.MessageID() != id {
+			t.Fatalf("expected message %d, got %d", id, m.MessageID())
+		}
+		m.Ack()
+		if pc := nextPacket[*packets.PubcompPacket](t, b); pc.MessageID != id {
+			t.Fatalf("expected PUBCOMP %d, got %d", id, pc.MessageID)
+		}
+	}
+}
+
+// Test_Qos2DeliverOnPubrel_HandlerAfterConnectionLost checks that the PUBCOMP for a message whose handler returns
+// after the connection is lost is dropped (rather than blocking the handler goroutine, and so Close, forever)
+func Test_Qos2DeliverOnPubrel_HandlerAfterConnectionLost(t *testing.T) {
+	b := newFakeBroker()
+	started, release := make(chan struct{}), make(chan struct{})
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetOrderMatters(false).
+		SetAutoReconnect(false).
+		SetQos2DeliverOnPubrel(true).
+		SetDefaultPublishHandler(func(Client, Message) {
+			close(started)
+			<-release
+		}).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	if err := b.publish("a", 2, 1, "x"); err != nil {
+		t.Fatal(err)
+	}
+	nextPacket[*packets.PubrecPacket](t, b)
+	pr := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pr.MessageID = 1
+	if err := b.write(pr); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	b.dropConnection()
+	for i := 0; c.status.ConnectionStatus() != disconnected; i++ {
+		if i > 100 {
+			t.Fatal("connection loss not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+
+	closed := make(chan error)
+	go func() { closed <- c.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close blocked (handler goroutine stuck sending PUBCOMP)")
+	}
+}
@@ -19,6 +19,12 @@
 package mqtt
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -279,6 +285,19 @@ func Test_match(t *testing.T) {
 	R = "/+/♫/ッ/+/ø/☹☹☹"
 	T = "/b/♫/ッ/♫/ø/☹☹☹"
 	check(R, T, true)
+
+	// ** $ topics (routes beginning with a wildcard match these, unlike topic.Match) **
+	R = "#"
+	T = "$SYS/broker/uptime"
+	check(R, T, true)
+
+	R = "+/broker/uptime"
+	T = "$SYS/broker/uptime"
+	check(R, T, true)
+
+	R = "$SYS/#"
+	T = "$SYS/broker/uptime"
+	check(R, T, true)
 }
 
 func Test_MatchAndDispatch(t *testing.T) {
@@ -354,3 +373,439 @@ func Test_SharedSubscription_MatchAndDispatch(t *testing.T) {
 	}
 
 }
+
+func Test_parseRoutePattern(t *testing.T) {
+	tests := []struct {
+		pattern, filter, names string
+	}{
+		{"a/b/c", "a/b/c", "[]"},
+		{"a/+/#", "a/+/#", "[]"},
+		{"site/{site}/device/{id}/#rest", "site/+/device/+/#", "[ site  id rest]"},
+		{"$share/group/a/{id}", "$share/group/a/+", "[ id]"},
+		{"a/{}/x{id}/#rest/b", "a/{}/x{id}/#rest/b", "[]"},
+	}
+	for _, test := range tests {
+		filter, names := parseRoutePattern(test.pattern)
+		if filter != test.filter || fmt.Sprint(names) != test.names {
+			t.Errorf("%s: expected %s %s, got %s %v", test.pattern, test.filter, test.names, filter, names)
+		}
+	}
+}
+
+func Test_MatchAndDispatch_Params(t *testing.T) {
+	params := make(chan map[string]string, 10)
+	router := newRouter()
+	router.params = true
+	router.addRoute("site/{site}/device/{id}/#rest", func(c Client, m Message) {
+		params <- m.(ParamMessage).Params()
+	})
+	router.addRoute("$share/group/other/{id}", func(c Client, m Message) {
+		params <- map[string]string{"id": TopicParam(m, "id")}
+	})
+
+	msgs := make(chan *packets.PublishPacket)
+	router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100)})
+	tests := map[string]string{
+		"site/s1/device/d7/temp/inside": "map[id:d7 rest:temp/inside site:s1]",
+		"site/s1/device/d7":             "map[id:d7 rest: site:s1]",
+		"other/d8":                      "map[id:d8]",
+	}
+	for topic, exp := range tests {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = topic
+		msgs <- pub
+		select {
+		case got := <-params:
+			if fmt.Sprint(got) != exp {
+				t.Errorf("topic %s: expected %s, got %v", topic, exp, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("topic %s: handler not called", topic)
+		}
+	}
+	close(msgs)
+
+	router.deleteRoute("site/{site}/device/{id}/#rest")
+	if router.routes.Len() != 1 {
+		t.Errorf("route pattern should have been deleted")
+	}
+}
+
+// Test_RouteParams_Disabled checks that, unless SetRouteParams is used, a {name} level is a literal topic level
+func Test_RouteParams_Disabled(t *testing.T) {
+	b := newFakeBroker()
+	received := make(chan string, 10)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(10)
+
+	if tok := c.Subscribe("a/{id}", 1, func(_ Client, m Message) { received <- m.Topic() }); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	if sub := nextPacket[*packets.SubscribePacket](t, b); sub.Topics[0] != "a/{id}" {
+		t.Errorf("expected literal filter a/{id}, got %v", sub.Topics)
+	}
+	if err := b.publish("a/x", 0, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.publish("a/{id}", 0, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if topic := <-received; topic != "a/{id}" {
+		t.Errorf("unexpected delivery on %s", topic)
+	}
+	if tok := c.Unsubscribe("a/{id}"); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("unsubscribe failed: %v", tok.Error())
+	}
+	if unsub := nextPacket[*packets.UnsubscribePacket](t, b); unsub.Topics[0] != "a/{id}" {
+		t.Errorf("expected literal filter a/{id}, got %v", unsub.Topics)
+	}
+}
+
+func Test_MatchAndDispatch_Middleware(t *testing.T) {
+	calls := make(chan string, 10)
+	trace := func(name string) MessageMiddleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(c Client, m Message) {
+				calls <- name
+				next(c, m)
+			}
+		}
+	}
+
+	router := newRouter()
+	router.use(trace("global1"), trace("global2"))
+	router.addRoute("a", func(c Client, m Message) { calls <- "handler" }, trace("route"))
+	router.setDefaultHandler(func(c Client, m Message) { calls <- "default" })
+
+	msgs := make(chan *packets.PublishPacket)
+	router.matchAndDispatch(msgs, true, &client{oboundP: make(chan *PacketAndToken, 100)})
+
+	check := func(topic string, exp ...string) {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = topic
+		msgs <- pub
+		for _, e := range exp {
+			select {
+			case got := <-calls:
+				if got != e {
+					t.Errorf("topic %s: expected %s, got %s", topic, e, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("topic %s: timeout waiting for %s", topic, e)
+			}
+		}
+	}
+	check("a", "global1", "global2", "route", "handler")
+	check("b", "global1", "global2", "default")
+	close(msgs)
+}
+
+func Test_RecoverMiddleware(t *testing.T) {
+	var recovered interface{}
+	h := ChainMiddleware(func(c Client, m Message) { panic("boom") },
+		RecoverMiddleware(func(m Message, r interface{}) { recovered = r }))
+	h(nil, &message{topic: "a"})
+	if recovered != "boom" {
+		t.Errorf("expected panic to be recovered, got %v", recovered)
+	}
+}
+
+func Test_TimingMiddleware(t *testing.T) {
+	var took time.Duration
+	h := ChainMiddleware(func(c Client, m Message) { time.Sleep(10 * time.Millisecond) },
+		TimingMiddleware(func(m Message, d time.Duration) { took = d }))
+	h(nil, &message{topic: "a"})
+	if took < 10*time.Millisecond {
+		t.Errorf("expected duration >= 10ms, got %s", took)
+	}
+}
+
+// recordingLogger stores everything logged
+type recordingLogger struct{ lines []string }
+
+func (l *recordingLogger) Println(v ...interface{}) { l.lines = append(l.lines, fmt.Sprintln(v...)) }
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func Test_LoggingMiddleware(t *testing.T) {
+	l := &recordingLogger{}
+	called := false
+	h := ChainMiddleware(func(c Client, m Message) { called = true }, LoggingMiddleware(l))
+	h(nil, &message{topic: "sensors/1", qos: 1, messageID: 7, payload: []byte("hello")})
+	if !called {
+		t.Errorf("handler was not called")
+	}
+	if len(l.lines) != 1 || !strings.Contains(l.lines[0], "topic: sensors/1 qos: 1 id: 7") || !strings.Contains(l.lines[0], "size: 5") {
+		t.Errorf("unexpected log output %q", l.lines)
+	}
+}
+
+func Test_MatchAndDispatch_HandlerPanic(t *testing.T) {
+	for _, order := range []bool{true, false} {
+		for _, policy := range []HandlerPanicPolicy{HandlerPanicAck, HandlerPanicNoAck} {
+			reported := make(chan string, 1)
+			c := &client{oboundP: make(chan *PacketAndToken, 100)}
+			c.options.HandlerPanicPolicy = policy
+			c.options.OnHandlerPanic = func(_ Client, m Message, recovered interface{}, stack []byte) {
+				if len(stack) == 0 {
+					t.Errorf("stack should be provided")
+				}
+				reported <- fmt.Sprintf("%s/%d/%v", m.Topic(), m.MessageID(), recovered)
+			}
+
+			router := newRouter()
+			router.addRoute("a", func(c Client, m Message) { panic("bad payload") })
+			msgs := make(chan *packets.PublishPacket)
+			acks := router.matchAndDispatch(msgs, order, c)
+
+			pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pub.Qos = 2
+			pub.TopicName = "a"
+			pub.MessageID = 12
+			msgs <- pub
+
+			select {
+			case got := <-reported:
+				if got != "a/12/bad payload" {
+					t.Errorf("unexpected panic report %s", got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("panic not reported (order %t)", order)
+			}
+
+			select {
+			case a := <-acks:
+				if policy == HandlerPanicNoAck {
+					t.Errorf("message should not be acknowledged (order %t)", order)
+				} else if a.p.Details().MessageID != 12 {
+					t.Errorf("unexpected ack %v", a.p)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if policy == HandlerPanicAck {
+					t.Errorf("message should have been acknowledged (order %t)", order)
+				}
+			}
+			close(msgs)
+			for range acks {
+			}
+		}
+	}
+}
+
+func Test_HandlerPanicDisconnect(t *testing.T) {
+	lost := make(chan error, 1)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetAutoReconnect(false).
+		SetHandlerPanicPolicy(HandlerPanicDisconnect).
+		SetConnectionLostHandler(func(_ Client, err error) { lost <- err }).
+		SetCustomOpenConnectionFn(func(uri *url.URL, options ClientOptions) (net.Conn, error) {
+			cConn, sConn := net.Pipe()
+			go func() {
+				defer sConn.Close()
+				if _, err := packets.ReadPacket(sConn); err != nil {
+					return
+				}
+				ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				pub.TopicName, pub.Qos, pub.MessageID = "a", 1, 1
+				if ca.Write(sConn) != nil || pub.Write(sConn) != nil {
+					return
+				}
+				for {
+					if _, err := packets.ReadPacket(sConn); err != nil {
+						return
+					}
+				}
+			}()
+			return cConn, nil
+		})
+	c := NewClient(ops)
+	c.AddRoute("a", func(c Client, m Message) { panic("bad payload") })
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	select {
+	case err := <-lost:
+		if !errors.Is(err, ErrHandlerPanic) {
+			t.Errorf("expected ErrHandlerPanic, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection was not dropped")
+	}
+	if c.IsConnected() {
+		t.Errorf("client should not be connected")
+	}
+}
+
+func Test_MatchAndDispatch_WorkerPool(t *testing.T) {
+	c := &client{oboundP: make(chan *PacketAndToken, 100)}
+	c.options.DispatchWorkers = 2
+	c.options.DispatchQueueDepth = 1
+
+	release := make(chan struct{})
+	var running, maxRunning int32
+	var mu sync.Mutex
+	done := make(chan struct{}, 10)
+	router := newRouter()
+	router.addRoute("a", func(c Client, m Message) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		done <- struct{}{}
+	})
+	msgs := make(chan *packets.PublishPacket)
+	acks := router.matchAndDispatch(msgs, false, c)
+	go func() {
+		for range acks { // QoS 0 so no acks expected
+		}
+	}()
+
+	send := func() bool {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = "a"
+		select {
+		case msgs <- pub:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+	// 2 running, 1 queued and 1 held by the router waiting to be queued; the next should block
+	for i := 0; i < 4; i++ {
+		if !send() {
+			t.Fatalf("message %d should have been accepted", i)
+		}
+	}
+	if send() {
+		t.Fatalf("router should apply back-pressure when the queue is full")
+	}
+	if s := router.stats.queued.Load(); s < 1 {
+		t.Errorf("expected queued handlers, got %d", s)
+	}
+
+	close(release)
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("handler %d did not complete", i)
+		}
+	}
+	close(msgs)
+	if maxRunning != 2 {
+		t.Errorf("expected 2 concurrent handlers, got %d", maxRunning)
+	}
+	if router.stats.received.Load() != 4 || router.stats.highWater.Load() < 1 {
+		t.Errorf("unexpected stats received %d highwater %d", router.stats.received.Load(), router.stats.highWater.Load())
+	}
+}
+
+func Test_ackSequencer(t *testing.T) {
+	s := newAckSequencer(true)
+	var sent []int
+	ack := func(i int) func() { return func() { sent = append(sent, i) } }
+	seqs := make([]uint64, 5)
+	for i := range seqs {
+		seqs[i] = s.allocate()
+	}
+	s.complete(seqs[2], ack(2))
+	s.complete(seqs[1], nil) // not acknowledged
+	if len(sent) != 0 {
+		t.Fatalf("acks released before first message complete: %v", sent)
+	}
+	s.complete(seqs[0], ack(0))
+	s.complete(seqs[4], ack(4))
+	s.complete(seqs[3], ack(3))
+	if fmt.Sprint(sent) != "[0 2 3 4]" {
+		t.Errorf("acks not released in order: %v", sent)
+	}
+}
+
+func Test_MatchAndDispatch_Keyed(t *testing.T) {
+	c := &client{oboundP: make(chan *PacketAndToken, 100)}
+	c.options.KeyedDispatchWorkers = 2 // "dev/1" and "dev/2" are processed by different workers
+	c.options.DispatchQueueDepth = 1   // allows message 3 to be queued whilst message 1 is being processed
+	c.options.Order = true             // keyed dispatch takes precedence
+
+	release := make(chan struct{})
+	processed := make(chan uint16, 10)
+	router := newRouter()
+	router.addRoute("dev/+", func(c Client, m Message) {
+		if m.Topic() == "dev/1" && m.MessageID() == 1 {
+			<-release
+		}
+		processed <- m.MessageID()
+	})
+	msgs := make(chan *packets.PublishPacket)
+	ackOut := router.matchAndDispatch(msgs, c.options.Order, c)
+	acks := make(chan *PacketAndToken, 10) // the client continually reads acknowledgements
+	go func() {
+		for a := range ackOut {
+			acks <- a
+		}
+		close(acks)
+	}()
+
+	send := func(topic string, id uint16) {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName, pub.Qos, pub.MessageID = topic, 2, id
+		msgs <- pub
+	}
+	send("dev/1", 1) // blocks until released
+	send("dev/2", 2)
+	send("dev/1", 3) // must wait for 1
+	send("dev/2", 4)
+
+	// Messages for dev/2 should be processed without waiting for dev/1
+	for _, exp := range []uint16{2, 4} {
+		select {
+		case id := <-processed:
+			if id != exp {
+				t.Fatalf("expected message %d, got %d", exp, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d not processed whilst another key was blocked", exp)
+		}
+	}
+	// but no acknowledgements may be sent until message 1 has been processed
+	select {
+	case a := <-acks:
+		t.Fatalf("ack sent out of order: %v", a.p)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	for _, exp := range []uint16{1, 3} {
+		if id := <-processed; id != exp {
+			t.Errorf("expected message %d, got %d", exp, id)
+		}
+	}
+	for _, exp := range []uint16{1, 2, 3, 4} {
+		select {
+		case a := <-acks:
+			if a.p.Details().MessageID != exp {
+				t.Errorf("expected ack for %d, got %d", exp, a.p.Details().MessageID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("ack for %d not sent", exp)
+		}
+	}
+	close(msgs)
+	for range acks {
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func Test_Shutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	connect := func() (*fakeBroker, Client) {
+		b := newFakeBroker()
+		ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+			SetProtocolVersion(4).
+			SetOrderMatters(false).
+			SetDefaultPublishHandler(func(Client, Message) {
+				started <- struct{}{}
+				<-release
+			}).
+			SetCustomOpenConnectionFn(b.open)
+		c := NewClient(ops)
+		if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+			t.Fatalf("connect failed: %v", tok.Error())
+		}
+		if err := b.publish("a", 1, 1, "x"); err != nil {
+			t.Fatal(err)
+		}
+		<-started
+		return b, c
+	}
+
+	// Handler does not complete before the context expires
+	_, c := connect()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.(Shutdowner).Shutdown(ctx)
+	var se *ShutdownError
+	if !errors.As(err, &se) || se.HandlersActive != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if tok := c.Publish("a", 1, false, "x"); tok.Error() != ErrShuttingDown {
+		t.Fatalf("expected ErrShuttingDown, got %v", tok.Error())
+	}
+	release <- struct{}{}
+
+	// Shutdown waits for the handler to complete
+	b, c := connect()
+	if tok := c.Publish("b", 1, false, "x"); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("publish failed: %v", tok.Error())
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	start := time.Now()
+	if err := c.(Shutdowner).Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Shutdown returned before handler completed")
+	}
+	nextPacket[*packets.DisconnectPacket](t, b)
+	if c.IsConnected() {
+		t.Errorf("client should be disconnected")
+	}
+}
+
+// Test_Shutdown_Pending checks that messages read from the network, but not yet passed to a handler, are waited for
+func Test_Shutdown_Pending(t *testing.T) {
+	b := newFakeBroker()
+	release := make(chan struct{})
+	handled := make(chan string, 10)
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetDefaultPublishHandler(func(_ Client, m Message) {
+			<-release
+			handled <- string(m.Payload())
+		}).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	for i := uint16(1); i <= 2; i++ { // the second is held up behind the first (OrderMatters)
+		if err := b.publish("a", 1, i, fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; c.msgRouter.stats.pending.Load()+c.msgRouter.stats.active.Load() != 2; i++ {
+		if i > 100 {
+			t.Fatalf("messages not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var se *ShutdownError
+	if err := c.Shutdown(ctx); !errors.As(err, &se) || se.HandlersActive != 2 {
+		t.Fatalf("expected 2 messages outstanding, got %v", err)
+	}
+	close(release)
+	for _, want := range []string{"1", "2"} {
+		if got := <-handled; got != want {
+			t.Fatalf("expected %s, got %s", want, got)
+		}
+	}
+}
+
+// Test_Shutdown_ConnectionLost checks that messages remaining in the store are reported when the connection has
+// been lost
+func Test_Shutdown_ConnectionLost(t *testing.T) {
+	b := newFakeBroker()
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetCleanSession(false).
+		SetAutoReconnect(false).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Close()
+	b.noPuback.Store(true)
+	c.Publish("a", 1, false, "x")
+	pub := nextPacket[*packets.PublishPacket](t, b)
+	b.dropConnection()
+	for i := 0; c.status.ConnectionStatus() != disconnected; i++ {
+		if i > 100 {
+			t.Fatal("connection loss not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var se *ShutdownError
+	if err := c.Shutdown(ctx); !errors.As(err, &se) || len(se.Undelivered) != 1 || se.Undelivered[0].MessageID != pub.MessageID {
+		t.Fatalf("expected undelivered message %d, got %v", pub.MessageID, err)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// nextPacket returns the next packet of the type specified received by the broker (other packets are ignored)
+func nextPacket[T packets.ControlPacket](t *testing.T, b *fakeBroker) T {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case cp := <-b.received:
+			if p, ok := cp.(T); ok {
+				return p
+			}
+		case <-timeout:
+			var zero T
+			t.Fatalf("%T not received", zero)
+			return zero
+		}
+	}
+}
+
+func Test_SubscribeWithHandle(t *testing.T) {
+	b := newFakeBroker()
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(0)
+
+	received1, received2 := make(chan Message, 10), make(chan Message, 10)
+	s1, tok := c.SubscribeWithHandle("sensors/#", 1, func(_ Client, m Message) { received1 <- m })
+	if !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	nextPacket[*packets.SubscribePacket](t, b)
+	s2, tok := c.SubscribeWithHandle("sensors/#", 0, func(_ Client, m Message) { received2 <- m })
+	if !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	if sub := nextPacket[*packets.SubscribePacket](t, b); sub.Qoss[0] != 1 {
+		t.Errorf("second SUBSCRIBE should not downgrade QoS, got %d", sub.Qoss[0])
+	}
+
+	// Both handlers are called
+	_ = b.publish("sensors/1", 1, 1, "a")
+	for _, ch := range []chan Message{received1, received2} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("message not passed to both handlers")
+		}
+	}
+
+	// Paused handles drop messages (which are still acknowledged)
+	s2.Pause()
+	_ = b.publish("sensors/1", 1, 2, "b")
+	<-received1
+	for nextPacket[*packets.PubackPacket](t, b).MessageID != 2 {
+	}
+	if s2.Received() != 2 || s2.Dropped() != 1 || s1.Dropped() != 0 {
+		t.Errorf("unexpected counters s1 %d/%d, s2 %d/%d", s1.Received(), s1.Dropped(), s2.Received(), s2.Dropped())
+	}
+	s2.Resume()
+
+	// UNSUBSCRIBE is only sent when the last handle is released
+	if tok = s1.Unsubscribe(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("unsubscribe failed: %v", tok.Error())
+	}
+	_ = b.publish("sensors/1", 0, 0, "c")
+	select {
+	case <-received2:
+	case <-time.After(time.Second):
+		t.Fatal("message not passed to remaining handler")
+	}
+	if len(received1) != 0 {
+		t.Errorf("released handler should not be called")
+	}
+	if tok = s2.Unsubscribe(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("unsubscribe failed: %v", tok.Error())
+	}
+	unsub := nextPacket[*packets.UnsubscribePacket](t, b)
+	if unsub.Topics[0] != "sensors/#" {
+		t.Errorf("unexpected UNSUBSCRIBE %v", unsub.Topics)
+	}
+	select {
+	case <-s2.Unsubscribe().Done():
+	default:
+		t.Errorf("second Unsubscribe should return a completed token")
+	}
+	select {
+	case p := <-b.received:
+		if _, ok := p.(*packets.UnsubscribePacket); ok {
+			t.Errorf("UNSUBSCRIBE sent more than once")
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_SubscribeWithHandle_NotConnected(t *testing.T) {
+	c := NewClient(NewClientOptions()).(*client)
+	s, tok := c.SubscribeWithHandle("a", 1, func(Client, Message) {})
+	if tok.Error() == nil {
+		t.Fatal("expected error")
+	}
+	if len(c.subHandles) != 0 {
+		t.Errorf("failed handle should have been released")
+	}
+	if tok = s.Unsubscribe(); tok.Error() != nil {
+		t.Errorf("unexpected error %v", tok.Error())
+	}
+}
+
+// Test_SubscribeWithHandle_Plain checks that a plain Subscribe to a filter that also has handles is counted as a
+// holder of the subscription (and that a plain Unsubscribe does not unsubscribe whilst handles remain)
+func Test_SubscribeWithHandle_Plain(t *testing.T) {
+	b := newFakeBroker()
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(0)
+	noUnsubscribe := func() {
+		t.Helper()
+		select {
+		case p := <-b.received:
+			if _, ok := p.(*packets.UnsubscribePacket); ok {
+				t.Fatalf("unexpected UNSUBSCRIBE")
+			}
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	received := make(chan string, 10)
+	s, tok := c.SubscribeWithHandle("a/#", 1, func(_ Client, m Message) { received <- "handle" })
+	if !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	nextPacket[*packets.SubscribePacket](t, b)
+	if tok = c.Subscribe("a/#", 0, nil); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	if sub := nextPacket[*packets.SubscribePacket](t, b); sub.Qoss[0] != 1 {
+		t.Errorf("plain SUBSCRIBE should not downgrade QoS, got %d", sub.Qoss[0])
+	}
+
+	// A plain Unsubscribe does not starve the handle
+	if tok = c.Unsubscribe("a/#"); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("unsubscribe failed: %v", tok.Error())
+	}
+	noUnsubscribe()
+	_ = b.publish("a/b", 0, 0, "x")
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message not passed to handle following plain Unsubscribe")
+	}
+
+	// Releasing the last handle does not unsubscribe a filter also subscribed to with Subscribe
+	if tok = c.Subscribe("a/#", 1, func(Client, Message) { received <- "plain" }); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("subscribe failed: %v", tok.Error())
+	}
+	nextPacket[*packets.SubscribePacket](t, b)
+	if tok = s.Unsubscribe(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("unsubscribe failed: %v", tok.Error())
+	}
+	noUnsubscribe()
+	_ = b.publish("a/b", 0, 0, "x")
+	if r := <-received; r != "plain" {
+		t.Fatalf("message passed to %s", r)
+	}
+	if tok = c.Unsubscribe("a/#"); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("unsubscribe failed: %v", tok.Error())
+	}
+	if unsub := nextPacket[*packets.UnsubscribePacket](t, b); unsub.Topics[0] != "a/#" {
+		t.Errorf("unexpected UNSUBSCRIBE %v", unsub.Topics)
+	}
+}
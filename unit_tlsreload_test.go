@@ -0,0 +1,179 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert generates a self signed certificate expiring at notAfter and writes the cert/key to the files
+// provided
+func writeTestCert(t *testing.T, certFile, keyFile string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test-device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %s", err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unable to write cert: %s", err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("unable to write key: %s", err)
+	}
+}
+
+func Test_TLSReloader_Files(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	exp1 := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	writeTestCert(t, certFile, keyFile, exp1)
+
+	r, err := NewTLSReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("NewTLSReloader failed: %s", err)
+	}
+	if !r.Expiry().Equal(exp1) {
+		t.Errorf("expected expiry %s, got %s", exp1, r.Expiry())
+	}
+	if changed, err := r.Reload(); changed || err != nil {
+		t.Errorf("expected no change, got %v, %v", changed, err)
+	}
+
+	exp2 := exp1.Add(24 * time.Hour)
+	writeTestCert(t, certFile, keyFile, exp2)
+	if changed, err := r.Reload(); !changed || err != nil {
+		t.Fatalf("expected change, got %v, %v", changed, err)
+	}
+	if !r.Expiry().Equal(exp2) {
+		t.Errorf("expected expiry %s, got %s", exp2, r.Expiry())
+	}
+
+	// A broken file should not replace the working certificate
+	if err = os.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reload(); err == nil {
+		t.Errorf("expected error loading invalid key")
+	}
+	if cfg := r.TLSConfig(nil); len(cfg.Certificates) != 1 || !r.Expiry().Equal(exp2) {
+		t.Errorf("previous certificate should have been retained")
+	}
+}
+
+func Test_TLSReloader_Provider(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, time.Now().Add(time.Hour))
+
+	calls := 0
+	r, err := NewTLSReloaderFromProvider(func() (*tls.Config, error) {
+		calls++
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	})
+	if err != nil {
+		t.Fatalf("NewTLSReloaderFromProvider failed: %s", err)
+	}
+	r.SetReconnectOnChange(true).SetReconnectBeforeExpiry(2 * time.Hour)
+
+	_, connected := r.connectionConfig(nil)
+	connected()
+	if calls != 2 {
+		t.Errorf("expected provider to be called twice, got %d", calls)
+	}
+	if !r.ActiveExpiry().Equal(r.Expiry()) {
+		t.Errorf("active expiry should match loaded certificate")
+	}
+	if why := r.reconnectReason(false); why != nil {
+		t.Errorf("should not reconnect when certificate unchanged, got %v", why)
+	}
+
+	writeTestCert(t, certFile, keyFile, time.Now().Add(48*time.Hour))
+	changed, err := r.Reload()
+	if !changed || err != nil {
+		t.Fatalf("expected change, got %v, %v", changed, err)
+	}
+	if why := r.reconnectReason(changed); !errors.Is(why, ErrTLSCertificateChanged) {
+		t.Errorf("expected ErrTLSCertificateChanged, got %v", why)
+	}
+	r.SetReconnectOnChange(false)
+	if why := r.reconnectReason(changed); !errors.Is(why, ErrTLSCertificateExpiring) {
+		t.Errorf("expected ErrTLSCertificateExpiring, got %v", why)
+	}
+}
+
+func Test_TLSReloader_ConnectionAttempt(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, time.Now().Add(time.Hour))
+	r, err := NewTLSReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("NewTLSReloader failed: %s", err)
+	}
+
+	var used *tls.Config
+	ops := NewClientOptions().AddBroker("ssl://127.0.0.1:8883").
+		SetTLSConfig(&tls.Config{ServerName: "broker.example.com"}).
+		SetTLSReloader(r).
+		SetConnectionAttemptHandler(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+			used = tlsCfg
+			return tlsCfg
+		}).
+		SetCustomOpenConnectionFn(func(uri *url.URL, options ClientOptions) (net.Conn, error) {
+			return nil, errors.New("no network in test")
+		})
+	c := NewClient(ops).(*client)
+	if _, _, _, err = c.attemptConnection(); err == nil {
+		t.Fatalf("expected connection attempt to fail")
+	}
+	if used == nil || len(used.Certificates) != 1 {
+		t.Fatalf("expected certificate from TLSReloader to be used")
+	}
+	if used.ServerName != "broker.example.com" {
+		t.Errorf("TLSConfig from options should be retained")
+	}
+	if rr := c.OptionsReader(); rr.TLSReloader() != r {
+		t.Errorf("OptionsReader should return TLSReloader")
+	}
+}
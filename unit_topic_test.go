@@ -19,7 +19,15 @@
 package mqtt
 
 import (
+	"errors"
+	"math/rand"
+	"strings"
 	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/topic"
 )
 
 func Test_ValidateTopicAndQos_qos3(t *testing.T) {
@@ -49,3 +57,120 @@ func Test_ValidateTopicAndQos_H(t *testing.T) {
 		t.Fatalf("invalid error for bad multilevel topic filter")
 	}
 }
+
+// Test_RouteMatch_Property checks that routes match in the same way as the topic package (which has more
+// extensive tests), other than routes beginning with a wildcard also matching topics beginning with $
+func Test_RouteMatch_Property(t *testing.T) {
+	gen := func(r *rand.Rand, alphabet []string, max int) string {
+		levels := make([]string, 1+r.Intn(max))
+		for i := range levels {
+			if levels[i] = alphabet[r.Intn(len(alphabet))]; levels[i] == "#" && i != len(levels)-1 {
+				levels[i] = "+"
+			}
+		}
+		return strings.Join(levels, "/")
+	}
+	r := rand.New(rand.NewSource(1))
+	if err := quick.Check(func() bool {
+		filter, name := gen(r, []string{"a", "b", "$s", "", "+", "#"}, 3), gen(r, []string{"a", "b", "$s", ""}, 4)
+		if filter == "" || name == "" {
+			return true
+		}
+		exp := name
+		if topic.IsSystem(name) && (filter[0] == '+' || filter[0] == '#') {
+			exp = name[1:] // matched as if the level did not begin with $
+		}
+		if (&route{topic: filter}).match(name) != topic.MustCompile(filter).Match(exp) {
+			t.Logf("route %q, topic %q", filter, name)
+			return false
+		}
+		return true
+	}, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_ValidateTopicAndQos_Wildcard(t *testing.T) {
+	if e := validateTopicAndQos("a/b+", 0); e != topic.ErrWildcardLevel {
+		t.Fatalf("invalid error for wildcard within level: %v", e)
+	}
+}
+
+func Test_Publish_InvalidTopic(t *testing.T) {
+	b := newFakeBroker()
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(0)
+
+	tests := map[string]error{
+		"":                         topic.ErrEmpty,
+		"a/+":                      topic.ErrWildcardInName,
+		"a/#":                      topic.ErrWildcardInName,
+		"a\xff":                    topic.ErrInvalidUTF8,
+		strings.Repeat("a", 65536): topic.ErrTooLong,
+		"a\x00":                    topic.ErrNullCharacter,
+	}
+	for name, exp := range tests {
+		tok := c.Publish(name, 1, false, "payload")
+		var te *TopicError
+		if !tok.WaitTimeout(time.Second) || !errors.Is(tok.Error(), exp) || !errors.As(tok.Error(), &te) || te.Topic != name {
+			t.Errorf("%.10q: expected TopicError wrapping %v, got %v", name, exp, tok.Error())
+		}
+	}
+	if tok := c.Publish("a/b", 1, false, "payload"); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Errorf("valid publish failed: %v", tok.Error())
+	}
+	if p := nextPacket[*packets.PublishPacket](t, b); p.TopicName != "a/b" {
+		t.Errorf("unexpected publish to %q", p.TopicName)
+	}
+}
+
+func Test_Resume_QuarantineInvalid(t *testing.T) {
+	store := NewOrderedMemoryStore()
+	store.Open()
+	for id, name := range []string{"a/+", "a/b"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName, pub.Qos, pub.MessageID = name, 1, uint16(id+1)
+		store.Put(outboundKeyFromMID(pub.MessageID), pub)
+		time.Sleep(time.Millisecond) // OrderedMemoryStore orders by time
+	}
+
+	b := newFakeBroker()
+	ops := NewClientOptions().AddBroker("tcp://127.0.0.1:1883").
+		SetProtocolVersion(4).
+		SetCleanSession(false).
+		SetConnectRetry(true). // stored publish IDs are reserved before resume
+		SetStore(store).
+		SetCustomOpenConnectionFn(b.open)
+	c := NewClient(ops).(*client)
+	if tok := c.Connect(); !tok.WaitTimeout(time.Second) || tok.Error() != nil {
+		t.Fatalf("connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(0)
+
+	if p := nextPacket[*packets.PublishPacket](t, b); p.MessageID != 2 {
+		t.Fatalf("expected stored publish 2 to be resent, got %d", p.MessageID)
+	}
+	if p := store.Get(quarantinePrefix + outboundKeyFromMID(1)); p == nil {
+		t.Errorf("invalid packet should have been quarantined")
+	}
+	for _, key := range store.All() {
+		if key == outboundKeyFromMID(1) {
+			t.Errorf("invalid packet should have been removed")
+		}
+	}
+	if mIDFromKey(quarantinePrefix+outboundKeyFromMID(1)) != 1 {
+		t.Errorf("message ID should be available from quarantined key")
+	}
+	for i := 0; idsInUse(c) != 0; i++ { // publish 2 is freed when the PUBACK arrives
+		if i > 100 {
+			t.Fatalf("%d message IDs in use", idsInUse(c))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
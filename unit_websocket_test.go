@@ -0,0 +1,157 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v2.0
+ * and Eclipse Distribution License v1.0 which accompany this distribution.
+ *
+ * The Eclipse Public License is available at
+ *    https://www.eclipse.org/legal/epl-2.0/
+ * and the Eclipse Distribution License is available at
+ *   http://www.eclipse.org/org/documents/edl-v10.php.
+ *
+ * Contributors:
+ */
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestWebsocketServer starts a websocket server that echos back any binary messages received
+func newTestWebsocketServer(t *testing.T, pings *int32) *httptest.Server {
+	upgrader := websocket.Upgrader{
+		Subprotocols:      []string{"mqttv3.1", "mqtt"},
+		EnableCompression: true,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := http.Header{}
+		hdr.Add("Set-Cookie", "session=abc123")
+		ws, err := upgrader.Upgrade(w, r, hdr)
+		if err != nil {
+			t.Errorf("upgrade failed: %s", err)
+			return
+		}
+		defer ws.Close()
+		ws.SetPingHandler(func(data string) error {
+			atomic.AddInt32(pings, 1)
+			return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		for {
+			mt, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = ws.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func Test_Websocket_Options(t *testing.T) {
+	var pings int32
+	srv := newTestWebsocketServer(t, &pings)
+	defer srv.Close()
+
+	var handshakeStatus int
+	var cookie string
+	var dialed int32
+	opts := &WebsocketOptions{
+		EnableCompression: true,
+		Subprotocols:      []string{"mqttv3.1"},
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dialed, 1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		PingInterval: 20 * time.Millisecond,
+		HandshakeResponseHandler: func(resp *http.Response, err error) {
+			handshakeStatus = resp.StatusCode
+			for _, c := range resp.Cookies() {
+				if c.Name == "session" {
+					cookie = c.Value
+				}
+			}
+		},
+	}
+
+	conn, err := NewWebsocket("ws"+strings.TrimPrefix(srv.URL, "http"), nil, time.Second, nil, opts)
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	defer conn.Close()
+
+	if atomic.LoadInt32(&dialed) != 1 {
+		t.Errorf("expected custom NetDialContext to be used")
+	}
+	if handshakeStatus != http.StatusSwitchingProtocols {
+		t.Errorf("expected handshake status %d, got %d", http.StatusSwitchingProtocols, handshakeStatus)
+	}
+	if cookie != "abc123" {
+		t.Errorf("expected cookie to be available from handshake response, got %q", cookie)
+	}
+	if sp := conn.(*websocketConnector).Subprotocol(); sp != "mqttv3.1" {
+		t.Errorf("expected subprotocol mqttv3.1, got %q", sp)
+	}
+
+	payload := []byte("hello")
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	buf := make([]byte, len(payload))
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(buf, payload) {
+		t.Errorf("expected %q, got %q", payload, buf)
+	}
+
+	// Pongs are processed when reading so keep a read running while waiting for pings
+	go func() {
+		b := make([]byte, 10)
+		for {
+			if _, err := conn.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&pings) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&pings) < 2 {
+		t.Errorf("expected at least 2 websocket pings, got %d", atomic.LoadInt32(&pings))
+	}
+}
+
+func Test_Websocket_HandshakeFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	var handshakeStatus int
+	var handshakeErr error
+	opts := &WebsocketOptions{
+		HandshakeResponseHandler: func(resp *http.Response, err error) {
+			handshakeStatus = resp.StatusCode
+			handshakeErr = err
+		},
+	}
+	if _, err := NewWebsocket("ws"+strings.TrimPrefix(srv.URL, "http"), nil, time.Second, nil, opts); err == nil {
+		t.Fatalf("expected handshake to fail")
+	}
+	if handshakeStatus != http.StatusUnauthorized || handshakeErr == nil {
+		t.Errorf("expected handler to receive 401 and error, got %d / %v", handshakeStatus, handshakeErr)
+	}
+}
@@ -14,6 +14,7 @@
 package mqtt
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -21,6 +22,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -31,12 +33,44 @@ type WebsocketOptions struct {
 	ReadBufferSize  int
 	WriteBufferSize int
 	Proxy           ProxyFunction
+
+	// EnableCompression requests per-message deflate (RFC 7692); the server may decline this in which case
+	// messages are sent uncompressed. CompressionLevel (flate.BestSpeed to flate.BestCompression) is applied
+	// when compression is negotiated; 0 leaves the gorilla/websocket default in place.
+	EnableCompression bool
+	CompressionLevel  int
+
+	// Subprotocols lists the subprotocols requested during the handshake (in order of preference). If empty
+	// then "mqtt" is requested (as required by the MQTT spec).
+	Subprotocols []string
+
+	// NetDialContext, if set, is used to establish the underlying TCP connection. If nil then the Dialer from
+	// ClientOptions is used (allowing the local address, resolver etc to be set).
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// PingInterval enables WebSocket level ping frames (independent of MQTT PINGREQ); this can be useful when
+	// intermediaries (load balancers etc) drop connections that do not carry WebSocket traffic. If a pong is
+	// not received within PongTimeout (defaults to PingInterval) of a ping being sent the connection is closed.
+	// 0 (the default) disables WebSocket pings.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// HandshakeResponseHandler, if set, will be called with the HTTP response to the opening handshake (this
+	// enables the status, headers and cookies to be examined). It is called whether or not the handshake
+	// succeeds (err will be non-nil on failure) but only if a response was received.
+	HandshakeResponseHandler func(resp *http.Response, err error)
 }
 
 type ProxyFunction func(req *http.Request) (*url.URL, error)
 
 // NewWebsocket returns a new websocket and returns a net.Conn compatible interface using the gorilla/websocket package
 func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestHeader http.Header, options *WebsocketOptions) (net.Conn, error) {
+	return newWebsocket(host, tlsc, timeout, requestHeader, options, nil)
+}
+
+// newWebsocket establishes a websocket connection; if options.NetDialContext is nil then dialer will be used to
+// establish the underlying connection (unless that is also nil in which case the gorilla/websocket default is used)
+func newWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestHeader http.Header, options *WebsocketOptions, dialer *net.Dialer) (net.Conn, error) {
 	if timeout == 0 {
 		timeout = 10 * time.Second
 	}
@@ -45,20 +79,33 @@ func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestH
 		// Apply default options
 		options = &WebsocketOptions{}
 	}
-	if options.Proxy == nil {
-		options.Proxy = http.ProxyFromEnvironment
+	proxy := options.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
 	}
-	dialer := &websocket.Dialer{
-		Proxy:             options.Proxy,
+	subprotocols := options.Subprotocols
+	if len(subprotocols) == 0 {
+		subprotocols = []string{"mqtt"}
+	}
+	netDialContext := options.NetDialContext
+	if netDialContext == nil && dialer != nil {
+		netDialContext = dialer.DialContext
+	}
+	wsDialer := &websocket.Dialer{
+		Proxy:             proxy,
+		NetDialContext:    netDialContext,
 		HandshakeTimeout:  timeout,
-		EnableCompression: false,
+		EnableCompression: options.EnableCompression,
 		TLSClientConfig:   tlsc,
-		Subprotocols:      []string{"mqtt"},
+		Subprotocols:      subprotocols,
 		ReadBufferSize:    options.ReadBufferSize,
 		WriteBufferSize:   options.WriteBufferSize,
 	}
 
-	ws, resp, err := dialer.Dial(host, requestHeader)
+	ws, resp, err := wsDialer.Dial(host, requestHeader)
+	if resp != nil && options.HandshakeResponseHandler != nil {
+		options.HandshakeResponseHandler(resp, err)
+	}
 
 	if err != nil {
 		if resp != nil {
@@ -67,9 +114,18 @@ func NewWebsocket(host string, tlsc *tls.Config, timeout time.Duration, requestH
 		return nil, err
 	}
 
+	if options.EnableCompression && options.CompressionLevel != 0 {
+		if err := ws.SetCompressionLevel(options.CompressionLevel); err != nil {
+			WARN.Println(CLI, "unable to set websocket compression level", err)
+		}
+	}
+
 	wrapper := &websocketConnector{
 		Conn: ws,
 	}
+	if options.PingInterval > 0 {
+		wrapper.startPing(options.PingInterval, options.PongTimeout)
+	}
 	return wrapper, err
 }
 
@@ -81,6 +137,60 @@ type websocketConnector struct {
 	r   io.Reader
 	rio sync.Mutex
 	wio sync.Mutex
+
+	lastPong  atomic.Int64  // unix nano time that the last pong was received (only used if pings enabled)
+	stopPing  chan struct{} // closed to stop the ping goroutine (nil if pings not enabled)
+	closeOnce sync.Once
+}
+
+// startPing starts a goroutine that sends a WebSocket ping every interval; the connection will be closed if a pong
+// has not been received within timeout of the ping being sent.
+func (c *websocketConnector) startPing(interval, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	c.stopPing = make(chan struct{})
+	c.lastPong.Store(time.Now().UnixNano())
+	c.SetPongHandler(func(string) error {
+		c.lastPong.Store(time.Now().UnixNano())
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var pingSent time.Time
+		for {
+			select {
+			case <-c.stopPing:
+				return
+			case <-ticker.C:
+			}
+			lastPong := time.Unix(0, c.lastPong.Load())
+			if !pingSent.IsZero() && lastPong.Before(pingSent) && time.Since(pingSent) >= timeout {
+				ERROR.Println(NET, "websocket pong not received, closing connection")
+				_ = c.Close()
+				return
+			}
+			if pingSent.IsZero() || !lastPong.Before(pingSent) { // only one ping outstanding at a time
+				// WriteControl may be called concurrently with the other write methods
+				if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+					DEBUG.Println(NET, "websocket ping failed", err)
+					continue
+				}
+				pingSent = time.Now()
+			}
+		}
+	}()
+}
+
+// Close stops the ping goroutine (if running) and closes the underlying connection
+func (c *websocketConnector) Close() error {
+	c.closeOnce.Do(func() {
+		if c.stopPing != nil {
+			close(c.stopPing)
+		}
+	})
+	return c.Conn.Close()
 }
 
 // SetDeadline sets both the read and write deadlines